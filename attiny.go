@@ -22,12 +22,14 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"math"
 	"os/exec"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	"github.com/TheCacophonyProject/go-config"
 	"periph.io/x/periph/conn/i2c"
 	"periph.io/x/periph/conn/i2c/i2creg"
@@ -47,6 +49,25 @@ const (
 	wifiStateReg        = 0x13
 	versionReg          = 0x22
 
+	// Registers added in ATtiny firmware version 5. Multi-byte registers
+	// take up the following addresses too so their lengths are given.
+	timeReg              = 0x30 // Unix time written before powering off.
+	timeRegLen           = 4
+	sleptMinutesReg      = 0x34 // Minutes slept since the last power off.
+	sleptMinutesRegLen   = 2
+	wakeReasonReg        = 0x36
+	powerOffStatusReg    = 0x37 // Counting down flag then the minutes armed.
+	powerOffStatusRegLen = 3
+	powerOffCancelReg    = 0x3A
+
+	// First ATtiny version that can store the time over a power off, report
+	// why the Pi was powered on and confirm a power off.
+	timeKeepingVersion      = 5
+	wakeReasonVersion       = 5
+	powerOffConfirmVersion  = 5
+	powerOffConfirmAttempts = 3
+	powerOffConfirmInterval = 500 * time.Millisecond
+
 	// 3 was just a randomly chosen as the number for the attiny to return
 	// to indicate its presence.
 	magicReturn = 0x03
@@ -60,6 +81,10 @@ const (
 	txRetryInterval = time.Second
 
 	wifiInterface = "wlan0" // If this is changed also change it in /_release/10-notify-attiny to match
+
+	// The sleep register is 16 bits so this is the longest the ATtiny can be
+	// asked to power off for in one go.
+	maxSleepMinutes = math.MaxUint16
 )
 
 // connectATtiny sets up a i2c device for talking to the ATtiny and
@@ -91,9 +116,75 @@ func connectATtiny(battery config.Battery) (*attiny, error) {
 		log.Printf("wanted attiny version %d or higher. Have version %d."+
 			" Some features won't be available\n", wantedVersion, a.version)
 	}
+	if a.version >= wakeReasonVersion {
+		reason, err := a.readWakeReason()
+		if err != nil {
+			log.Printf("failed to read wake reason: %v", err)
+		} else {
+			a.wakeReason = reason
+		}
+	}
+	log.Printf("wake reason: %s", a.wakeReason)
 	return a, nil
 }
 
+// readWakeReason reads why the ATtiny last powered on the Pi. Values the
+// firmware reports that aren't known here are returned as wakeUnknown.
+func (a *attiny) readWakeReason() (wakeReason, error) {
+	if err := a.versionCheck(wakeReasonVersion); err != nil {
+		return wakeUnknown, err
+	}
+	b, err := a.readUint8(wakeReasonReg)
+	if err != nil {
+		return wakeUnknown, err
+	}
+	if reason := wakeReason(b); reason <= wakeButton {
+		return reason, nil
+	}
+	return wakeUnknown, nil
+}
+
+// wakeReason is why the ATtiny last powered on the Pi, as reported by the
+// firmware.
+type wakeReason uint8
+
+const (
+	wakeUnknown wakeReason = iota
+	wakePowerRestored
+	wakeScheduled
+	wakeWatchdog
+	wakeButton
+)
+
+func (r wakeReason) String() string {
+	switch r {
+	case wakePowerRestored:
+		return "power-restored"
+	case wakeScheduled:
+		return "scheduled"
+	case wakeWatchdog:
+		return "watchdog"
+	case wakeButton:
+		return "button"
+	}
+	return "unknown"
+}
+
+// reportPowerOn makes a power-on event with why the Pi was powered on. It is
+// called after the clock has been restored so the event has the right time.
+func reportPowerOn(reason wakeReason) {
+	err := addEvent(eventclient.Event{
+		Timestamp: clock.Now(),
+		Type:      "power-on",
+		Details: map[string]interface{}{
+			"reason": reason.String(),
+		},
+	})
+	if err != nil {
+		log.Printf("failed to make power-on event: %v", err)
+	}
+}
+
 func detectATtiny(dev *i2c.Dev, dev2 *i2c.Dev) *i2c.Dev {
 	attempts := 0
 	for {
@@ -112,7 +203,7 @@ func detectATtiny(dev *i2c.Dev, dev2 *i2c.Dev) *i2c.Dev {
 			return nil
 		}
 
-		time.Sleep(connectAttemptInterval)
+		clock.Sleep(connectAttemptInterval)
 	}
 }
 
@@ -121,6 +212,8 @@ type attiny struct {
 	dev     *i2c.Dev
 	version uint8
 
+	wakeReason wakeReason
+
 	battery          config.Battery
 	checkedOnBattery bool
 	onBattery        bool
@@ -147,14 +240,116 @@ func (a *attiny) readUint8(reg byte) (uint8, error) {
 }
 
 // PowerOff asks the ATtiny to turn the system off for the number of
-// minutes specified.
+// minutes specified. Minutes that don't fit the sleep register are an error
+// instead of being ignored, so the caller knows the device is staying on.
+// Newer ATtiny versions are checked to be counting down, and if not the power
+// off is cancelled and an error returned.
 func (a *attiny) PowerOff(minutes int) error {
-	if minutes <= 0 {
-		return nil
+	if err := checkSleepMinutes(minutes); err != nil {
+		return err
+	}
+	if a.version >= timeKeepingVersion {
+		// Failing to store the time shouldn't stop the device powering off.
+		if err := a.storeTime(clock.Now()); err != nil {
+			log.Printf("failed to store time in attiny: %v", err)
+		}
 	}
 	lb := byte(minutes / 256)
 	rb := byte(minutes % 256)
-	return a.write(sleepReg, []byte{lb, rb})
+	if err := a.write(sleepReg, []byte{lb, rb}); err != nil {
+		return err
+	}
+	if a.version < powerOffConfirmVersion {
+		return nil
+	}
+	if err := a.confirmPowerOff(minutes); err != nil {
+		if cancelErr := a.CancelPowerOff(); cancelErr != nil {
+			log.Printf("failed to cancel power off: %v", cancelErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// CancelPowerOff stops the ATtiny counting down to power off.
+func (a *attiny) CancelPowerOff() error {
+	if err := a.versionCheck(powerOffConfirmVersion); err != nil {
+		return err
+	}
+	return a.write(powerOffCancelReg, nil)
+}
+
+// confirmPowerOff checks the ATtiny is counting down to power off for the
+// given minutes.
+func (a *attiny) confirmPowerOff(minutes int) error {
+	var err error
+	for i := 0; i < powerOffConfirmAttempts; i++ {
+		if i > 0 {
+			clock.Sleep(powerOffConfirmInterval)
+		}
+		b := make([]byte, powerOffStatusRegLen)
+		if err = a.tx(b, []byte{powerOffStatusReg}); err != nil {
+			continue
+		}
+		armed := int(binary.BigEndian.Uint16(b[1:]))
+		if b[0] == 1 && armed == minutes {
+			return nil
+		}
+		err = fmt.Errorf("attiny isn't counting down to power off for %d minutes (counting: %t, minutes: %d)",
+			minutes, b[0] == 1, armed)
+	}
+	return err
+}
+
+// storeTime writes t to the ATtiny so the time can be worked out again after
+// the Pi has been powered off.
+func (a *attiny) storeTime(t time.Time) error {
+	if err := a.versionCheck(timeKeepingVersion); err != nil {
+		return err
+	}
+	b := make([]byte, timeRegLen)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	return a.write(timeReg, b)
+}
+
+// readStoredTime returns the time stored before the last power off and how
+// many minutes the ATtiny has counted since. A zero time is returned if no
+// time was stored.
+func (a *attiny) readStoredTime() (time.Time, int, error) {
+	if err := a.versionCheck(timeKeepingVersion); err != nil {
+		return time.Time{}, 0, err
+	}
+	b := make([]byte, timeRegLen)
+	if err := a.tx(b, []byte{timeReg}); err != nil {
+		return time.Time{}, 0, err
+	}
+	m := make([]byte, sleptMinutesRegLen)
+	if err := a.tx(m, []byte{sleptMinutesReg}); err != nil {
+		return time.Time{}, 0, err
+	}
+	secs := binary.BigEndian.Uint32(b)
+	if secs == 0 {
+		return time.Time{}, 0, nil
+	}
+	return time.Unix(int64(secs), 0), int(binary.BigEndian.Uint16(m)), nil
+}
+
+// clearStoredTime zeroes the time stored in the ATtiny so it isn't used again
+// after a later boot that wasn't from a scheduled power off.
+func (a *attiny) clearStoredTime() error {
+	if err := a.versionCheck(timeKeepingVersion); err != nil {
+		return err
+	}
+	return a.write(timeReg, make([]byte, timeRegLen))
+}
+
+// checkSleepMinutes returns an error if the ATtiny can't power off for
+// minutes in one go.
+func checkSleepMinutes(minutes int) error {
+	if minutes <= 0 || minutes > maxSleepMinutes {
+		return fmt.Errorf("can't power off for %d minutes, must be between 1 and %d", minutes, maxSleepMinutes)
+	}
+	return nil
 }
 
 // PingWatchdog ping's the ATTiny's watchdog timer to prevent it from
@@ -260,6 +455,6 @@ func (a *attiny) tx(w, r []byte) error {
 		if attempts >= maxTxAttempts {
 			return err
 		}
-		time.Sleep(txRetryInterval)
+		clock.Sleep(txRetryInterval)
 	}
 }
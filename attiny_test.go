@@ -0,0 +1,296 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/periph/conn/i2c"
+)
+
+// fakeI2CBus acts as the ATtiny's registers. A read returns the bytes from the
+// register onwards and a write sets them.
+type fakeI2CBus struct {
+	regs   map[byte]byte
+	writes [][]byte
+	reads  map[byte]int
+	// lengths is the most bytes read or written at each register.
+	lengths map[byte]int
+	// failReads is how many more reads of a register will fail.
+	failReads map[byte]int
+}
+
+func newFakeATtiny(version uint8) (*attiny, *fakeI2CBus) {
+	bus := &fakeI2CBus{
+		regs:      map[byte]byte{},
+		reads:     map[byte]int{},
+		lengths:   map[byte]int{},
+		failReads: map[byte]int{},
+	}
+	return &attiny{dev: &i2c.Dev{Bus: bus, Addr: attinyAddress}, version: version}, bus
+}
+
+func (b *fakeI2CBus) Tx(addr uint16, w, r []byte) error {
+	if len(w) == 0 {
+		return errors.New("no register given")
+	}
+	reg := w[0]
+	if len(r) > 0 {
+		b.reads[reg]++
+		if len(r) > b.lengths[reg] {
+			b.lengths[reg] = len(r)
+		}
+		if b.failReads[reg] > 0 {
+			b.failReads[reg]--
+			return errors.New("read failed")
+		}
+		for i := range r {
+			r[i] = b.regs[reg+byte(i)]
+		}
+		return nil
+	}
+	if length, ok := b.lengths[reg]; !ok || len(w)-1 > length {
+		b.lengths[reg] = len(w) - 1
+	}
+	b.writes = append(b.writes, append([]byte{}, w...))
+	for i, v := range w[1:] {
+		b.regs[reg+byte(i)] = v
+	}
+	return nil
+}
+
+func (b *fakeI2CBus) SetSpeed(hz int64) error {
+	return nil
+}
+
+func TestCheckSleepMinutes(t *testing.T) {
+	assert.NoError(t, checkSleepMinutes(1))
+	assert.NoError(t, checkSleepMinutes(maxSleepMinutes))
+	assert.Error(t, checkSleepMinutes(maxSleepMinutes+1))
+	// These used to be ignored but now fail so the device doesn't think
+	// it has powered off.
+	assert.Error(t, checkSleepMinutes(0))
+	assert.Error(t, checkSleepMinutes(-5))
+
+	a := &simATtiny{}
+	assert.Error(t, a.PowerOff(0))
+	assert.Zero(t, a.minutes)
+	assert.NoError(t, a.PowerOff(maxSleepMinutes))
+	assert.Equal(t, maxSleepMinutes, a.minutes)
+}
+
+// The bytes read from or written to a register take up the following
+// addresses, so they mustn't run into another register. The lengths are
+// taken from what the attiny methods actually send over the bus.
+func TestRegistersDontOverlap(t *testing.T) {
+	restoreGlobals(t)
+	clock = &simClock{now: time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)}
+	a, bus := newFakeATtiny(timeKeepingVersion)
+	a.battery.EnableVoltageReadings = true
+	setCountingDown(bus, 300)
+	assert.NoError(t, a.PowerOff(300))
+	assert.NoError(t, a.CancelPowerOff())
+	assert.NoError(t, a.PingWatchdog())
+	_, _, err := a.readStoredTime()
+	assert.NoError(t, err)
+	_, err = a.readBatteryValue()
+	assert.NoError(t, err)
+	for _, reg := range []byte{versionReg, wakeReasonReg} {
+		_, err = a.readUint8(reg)
+		assert.NoError(t, err)
+	}
+	// UpdateWifiState runs ip so it's written here instead.
+	assert.NoError(t, a.write(wifiStateReg, []byte{1}))
+
+	type register struct {
+		name   string
+		addr   int
+		length int
+	}
+	names := map[byte]string{
+		sleepReg:            "sleep",
+		watchdogReg:         "watchdog",
+		wifiStateReg:        "wifiState",
+		batteryVoltageLoReg: "batteryVoltageLo",
+		batteryVoltageHiReg: "batteryVoltageHi",
+		versionReg:          "version",
+		timeReg:             "time",
+		sleptMinutesReg:     "sleptMinutes",
+		wakeReasonReg:       "wakeReason",
+		powerOffStatusReg:   "powerOffStatus",
+		powerOffCancelReg:   "powerOffCancel",
+	}
+	var registers []register
+	for reg, name := range names {
+		length, ok := bus.lengths[reg]
+		assert.True(t, ok, "%s register wasn't used", name)
+		if length == 0 {
+			length = 1
+		}
+		registers = append(registers, register{name, int(reg), length})
+	}
+	assert.Len(t, bus.lengths, len(names), "a register used isn't listed")
+	assert.Equal(t, 2, bus.lengths[sleepReg])
+	assert.Equal(t, timeRegLen, bus.lengths[timeReg])
+
+	// Before version 5 the ATtiny took the bytes written to sleep as one
+	// value without using the next address, and watchdog was already
+	// straight after it, so that pair is left as it is.
+	legacy := map[string]bool{"sleep": true, "watchdog": true}
+	sort.Slice(registers, func(i, j int) bool { return registers[i].addr < registers[j].addr })
+	for i := 1; i < len(registers); i++ {
+		prev, r := registers[i-1], registers[i]
+		if legacy[prev.name] && legacy[r.name] {
+			continue
+		}
+		assert.GreaterOrEqual(t, r.addr, prev.addr+prev.length,
+			"%s register overlaps %s register", r.name, prev.name)
+	}
+}
+
+// setCountingDown sets the power off status registers to show the ATtiny
+// counting down to power off for minutes.
+func setCountingDown(bus *fakeI2CBus, minutes int) {
+	bus.regs[powerOffStatusReg] = 1
+	bus.regs[powerOffStatusReg+1] = byte(minutes / 256)
+	bus.regs[powerOffStatusReg+2] = byte(minutes % 256)
+}
+
+func TestConfirmPowerOff(t *testing.T) {
+	restoreGlobals(t)
+	c := &simClock{now: time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)}
+	clock = c
+	cancel := []byte{powerOffCancelReg}
+	sleep := []byte{sleepReg, 0x01, 0x2c}
+
+	// Counting down for the minutes asked for.
+	a, bus := newFakeATtiny(powerOffConfirmVersion)
+	setCountingDown(bus, 300)
+	assert.NoError(t, a.PowerOff(300))
+	assert.Equal(t, sleep, bus.writes[len(bus.writes)-1])
+	assert.Equal(t, 1, bus.reads[powerOffStatusReg])
+
+	// The first two attempts fail to read the status but the third works.
+	a, bus = newFakeATtiny(powerOffConfirmVersion)
+	setCountingDown(bus, 300)
+	bus.failReads[powerOffStatusReg] = 2 * maxTxAttempts
+	start := c.now
+	assert.NoError(t, a.PowerOff(300))
+	assert.Equal(t, 2*maxTxAttempts+1, bus.reads[powerOffStatusReg])
+	assert.Equal(t, 2*powerOffConfirmInterval+2*(maxTxAttempts-1)*txRetryInterval, c.now.Sub(start))
+	assert.NotContains(t, bus.writes, cancel)
+
+	// All three attempts fail to read the status so it is cancelled.
+	a, bus = newFakeATtiny(powerOffConfirmVersion)
+	setCountingDown(bus, 300)
+	bus.failReads[powerOffStatusReg] = powerOffConfirmAttempts * maxTxAttempts
+	assert.Error(t, a.PowerOff(300))
+	assert.Equal(t, powerOffConfirmAttempts*maxTxAttempts, bus.reads[powerOffStatusReg])
+	assert.Equal(t, cancel, bus.writes[len(bus.writes)-1])
+
+	// Counting down for a different number of minutes.
+	a, bus = newFakeATtiny(powerOffConfirmVersion)
+	setCountingDown(bus, 60)
+	assert.Error(t, a.PowerOff(300))
+	assert.Equal(t, powerOffConfirmAttempts, bus.reads[powerOffStatusReg])
+	assert.Equal(t, cancel, bus.writes[len(bus.writes)-1])
+
+	// Not counting down.
+	a, bus = newFakeATtiny(powerOffConfirmVersion)
+	setCountingDown(bus, 300)
+	bus.regs[powerOffStatusReg] = 0
+	assert.Error(t, a.PowerOff(300))
+	assert.Equal(t, cancel, bus.writes[len(bus.writes)-1])
+
+	// Older versions can't confirm the power off.
+	a, bus = newFakeATtiny(powerOffConfirmVersion - 1)
+	assert.NoError(t, a.PowerOff(300))
+	assert.Equal(t, [][]byte{sleep}, bus.writes)
+	assert.Zero(t, bus.reads[powerOffStatusReg])
+}
+
+func TestCancelPowerOff(t *testing.T) {
+	a, bus := newFakeATtiny(powerOffConfirmVersion)
+	assert.NoError(t, a.CancelPowerOff())
+	assert.Equal(t, [][]byte{{powerOffCancelReg}}, bus.writes)
+
+	a, bus = newFakeATtiny(powerOffConfirmVersion - 1)
+	assert.Error(t, a.CancelPowerOff())
+	assert.Empty(t, bus.writes)
+}
+
+func TestStoredTime(t *testing.T) {
+	a, bus := newFakeATtiny(timeKeepingVersion)
+	stored := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+	assert.NoError(t, a.storeTime(stored))
+	assert.Equal(t, [][]byte{{timeReg, 0x6a, 0x1d, 0x4a, 0x10}}, bus.writes)
+
+	bus.regs[sleptMinutesReg], bus.regs[sleptMinutesReg+1] = 0x01, 0x2c
+	readTime, sleptMinutes, err := a.readStoredTime()
+	assert.NoError(t, err)
+	assert.True(t, stored.Equal(readTime))
+	assert.Equal(t, 300, sleptMinutes)
+
+	assert.NoError(t, a.clearStoredTime())
+	readTime, _, err = a.readStoredTime()
+	assert.NoError(t, err)
+	assert.True(t, readTime.IsZero())
+
+	old, _ := newFakeATtiny(timeKeepingVersion - 1)
+	assert.Error(t, old.storeTime(stored))
+	_, _, err = old.readStoredTime()
+	assert.Error(t, err)
+}
+
+func TestReadWakeReason(t *testing.T) {
+	tests := []struct {
+		reg  byte
+		want wakeReason
+		name string
+	}{
+		{0, wakeUnknown, "unknown"},
+		{1, wakePowerRestored, "power-restored"},
+		{2, wakeScheduled, "scheduled"},
+		{3, wakeWatchdog, "watchdog"},
+		{4, wakeButton, "button"},
+		{5, wakeUnknown, "unknown"},
+		{255, wakeUnknown, "unknown"},
+	}
+	for _, tc := range tests {
+		a, bus := newFakeATtiny(wakeReasonVersion)
+		bus.regs[wakeReasonReg] = tc.reg
+		reason, err := a.readWakeReason()
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, reason, "register value %d", tc.reg)
+		assert.Equal(t, tc.name, reason.String(), "register value %d", tc.reg)
+	}
+
+	a, bus := newFakeATtiny(wakeReasonVersion - 1)
+	bus.regs[wakeReasonReg] = byte(wakeScheduled)
+	_, err := a.readWakeReason()
+	assert.Error(t, err)
+}
+
+func TestReportPowerOn(t *testing.T) {
+	restoreGlobals(t)
+	now := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+	clock = &simClock{now: now}
+	var events []eventclient.Event
+	addEvent = func(e eventclient.Event) error {
+		events = append(events, e)
+		return nil
+	}
+
+	reportPowerOn(wakeScheduled)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "power-on", events[0].Type)
+	assert.True(t, now.Equal(events[0].Timestamp))
+	assert.Equal(t, map[string]interface{}{"reason": "scheduled"}, events[0].Details)
+}
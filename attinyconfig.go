@@ -19,13 +19,277 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/TheCacophonyProject/go-config"
-	"github.com/TheCacophonyProject/window"
 )
 
 type AttinyConfig struct {
-	OnWindow *window.Window
-	Battery  config.Battery
+	OnWindow     *Schedule
+	PowerWindows []PowerWindow
+	Location     config.Location
+	Battery      config.Battery
+	Salt         Salt
+	Power        Power
+	Shutdown     Shutdown
+	Heartbeat    HeartbeatConfig
+	Device       config.Device
+}
+
+const PowerWindowsKey = "power-windows"
+
+// PowerWindow is a daily window that the device should be powered on for.
+// If no power windows are configured then the power-on and power-off times
+// from the windows section are used.
+type PowerWindow struct {
+	PowerOn  string `mapstructure:"power-on"`
+	PowerOff string `mapstructure:"power-off"`
+
+	// The rules below limit which days the window starts on. They are all
+	// optional and the window must match all of the ones given.
+
+	// Days is a list of days of the week ("mon", "tue", ...), "weekdays" or
+	// "weekends".
+	Days []string `mapstructure:"days"`
+	// From and To are a range of dates (MM-DD) that repeats each year.
+	// The range can go over the new year, e.g. "11-01" to "02-28".
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+	// Every is how often, in days, the window is used. Days are counted
+	// from EveryFrom (YYYY-MM-DD) or 1970-01-01 if not set.
+	Every     int    `mapstructure:"every"`
+	EveryFrom string `mapstructure:"every-from"`
+}
+
+const SaltKey = "salt"
+
+// Salt controls which running salt jobs will delay the device turning off.
+type Salt struct {
+	// DelayShutdownFunctions is the list of salt functions (e.g. "state.apply")
+	// worth staying on for. If empty then any running salt job will delay
+	// shutdown.
+	DelayShutdownFunctions []string `mapstructure:"delay-shutdown-functions"`
+}
+
+func DefaultSalt() Salt {
+	return Salt{
+		DelayShutdownFunctions: []string{},
+	}
+}
+
+const PowerKey = "power"
+
+// Power controls the timing around powering the device off and on.
+type Power struct {
+	// WakeLead is how long before a window starts the device is woken.
+	WakeLead time.Duration `mapstructure:"wake-lead"`
+	// MinOffDuration is the shortest time until the next window that the
+	// device will power off for. If the window starts sooner it stays on.
+	MinOffDuration time.Duration `mapstructure:"min-off-duration"`
+	// WindowEndMargin is how long before a window ends the final heartbeat
+	// and events are sent.
+	WindowEndMargin time.Duration `mapstructure:"window-end-margin"`
+	// InitialGracePeriod is how long to stay on after booting before the
+	// window is applied, giving time to do something with the device.
+	InitialGracePeriod time.Duration `mapstructure:"initial-grace-period"`
+	// While the clock can't be trusted the window can't be worked out, so
+	// the device stays on for UntrustedOnDuration and then powers off for
+	// UntrustedOffDuration, to give NTP a chance without flattening the
+	// battery.
+	UntrustedOnDuration  time.Duration `mapstructure:"untrusted-on"`
+	UntrustedOffDuration time.Duration `mapstructure:"untrusted-off"`
+}
+
+func DefaultPower() Power {
+	return Power{
+		WakeLead:             2 * time.Minute,
+		MinOffDuration:       15 * time.Minute,
+		WindowEndMargin:      3 * time.Minute,
+		InitialGracePeriod:   20 * time.Minute,
+		UntrustedOnDuration:  time.Hour,
+		UntrustedOffDuration: 3 * time.Hour,
+	}
+}
+
+// Validate checks the durations are in whole minutes, which is all the
+// ATtiny can sleep in, and that powering off always sleeps for at least a
+// minute.
+func (p Power) Validate() error {
+	for name, d := range map[string]time.Duration{
+		"wake-lead":        p.WakeLead,
+		"min-off-duration": p.MinOffDuration,
+		"untrusted-off":    p.UntrustedOffDuration,
+	} {
+		if d < 0 || d%time.Minute != 0 {
+			return fmt.Errorf("power %s of %s must be whole minutes and not negative", name, d)
+		}
+	}
+	if p.WindowEndMargin < 0 {
+		return fmt.Errorf("power window-end-margin of %s can't be negative", p.WindowEndMargin)
+	}
+	if p.InitialGracePeriod < 0 {
+		return fmt.Errorf("power initial-grace-period of %s can't be negative", p.InitialGracePeriod)
+	}
+	if p.UntrustedOnDuration < 0 {
+		return fmt.Errorf("power untrusted-on of %s can't be negative", p.UntrustedOnDuration)
+	}
+	if p.UntrustedOffDuration < time.Minute || p.UntrustedOffDuration > maxSleepMinutes*time.Minute {
+		return fmt.Errorf("power untrusted-off of %s must be between a minute and %d minutes",
+			p.UntrustedOffDuration, maxSleepMinutes)
+	}
+	if p.MinOffDuration < p.WakeLead+time.Minute {
+		return fmt.Errorf("power min-off-duration of %s must be at least a minute longer than the wake-lead of %s",
+			p.MinOffDuration, p.WakeLead)
+	}
+	if p.UntrustedOffDuration < p.MinOffDuration {
+		return fmt.Errorf("power untrusted-off of %s can't be shorter than the min-off-duration of %s",
+			p.UntrustedOffDuration, p.MinOffDuration)
+	}
+	return nil
+}
+
+const ShutdownKey = "shutdown"
+
+// Shutdown controls what is done before the device powers off.
+type Shutdown struct {
+	// Units are systemd units to stop before powering off.
+	Units []string `mapstructure:"units"`
+	// Timeout is how long to wait for the units to stop and for D-Bus
+	// listeners that have inhibited shutdown to finish.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func DefaultShutdown() Shutdown {
+	return Shutdown{
+		Units:   []string{},
+		Timeout: time.Minute,
+	}
+}
+
+const HeartbeatKey = "heartbeat"
+
+// HeartbeatConfig controls how often heartbeats are sent and how hard to try.
+type HeartbeatConfig struct {
+	// InitialDelay is how long after the window starts, or after booting in
+	// the window, to send the first heartbeat. The final heartbeat is valid
+	// until twice this after the next window starts.
+	InitialDelay time.Duration `mapstructure:"initial-delay"`
+	// Interval is how long each heartbeat is valid for.
+	Interval time.Duration `mapstructure:"interval"`
+	// PenultimateBeforeEnd is how long before the window ends the second to
+	// last heartbeat is valid until.
+	PenultimateBeforeEnd time.Duration `mapstructure:"penultimate-before-end"`
+	// MaxAttempts and AttemptDelay are how many times to try sending each
+	// heartbeat and how long to wait between tries.
+	MaxAttempts  int           `mapstructure:"max-attempts"`
+	AttemptDelay time.Duration `mapstructure:"attempt-delay"`
+	// These are passed to the modem connection requester.
+	ConnTimeout       time.Duration `mapstructure:"connection-timeout"`
+	ConnRetryInterval time.Duration `mapstructure:"connection-retry-interval"`
+	ConnMaxRetries    int           `mapstructure:"connection-max-retries"`
+	// Sinks are where heartbeats are sent, any of "api", "mqtt", "file" and
+	// "socket".
+	Sinks []string `mapstructure:"sinks"`
+	// File is the file heartbeats are appended to for the file sink and
+	// Socket the unix socket they are written to for the socket sink.
+	File   string        `mapstructure:"file"`
+	Socket string        `mapstructure:"socket"`
+	MQTT   HeartbeatMQTT `mapstructure:"mqtt"`
+}
+
+// HeartbeatMQTT is the broker the mqtt sink publishes heartbeats to. If Topic
+// isn't set it is "cacophony/<device name>/heartbeat".
+type HeartbeatMQTT struct {
+	Broker   string        `mapstructure:"broker"`
+	Topic    string        `mapstructure:"topic"`
+	ClientID string        `mapstructure:"client-id"`
+	Username string        `mapstructure:"username"`
+	Password string        `mapstructure:"password"`
+	QoS      byte          `mapstructure:"qos"`
+	Retain   bool          `mapstructure:"retain"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+}
+
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		InitialDelay:         30 * time.Minute,
+		Interval:             4 * time.Hour,
+		PenultimateBeforeEnd: time.Hour,
+		MaxAttempts:          3,
+		AttemptDelay:         5 * time.Second,
+		ConnTimeout:          2 * time.Minute,
+		ConnRetryInterval:    time.Minute,
+		ConnMaxRetries:       3,
+		Sinks:                []string{apiSinkName},
+		MQTT: HeartbeatMQTT{
+			QoS:     1,
+			Retain:  true,
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Minimums for the heartbeat timings. Heartbeats are sent 5 minutes before
+// the one before expires, so they need to be valid for longer than that.
+const (
+	minHeartbeatInterval             = 15 * time.Minute
+	minHeartbeatPenultimateBeforeEnd = 10 * time.Minute
+)
+
+func (h HeartbeatConfig) Validate() error {
+	if h.InitialDelay < 0 {
+		return fmt.Errorf("heartbeat initial-delay of %s can't be negative", h.InitialDelay)
+	}
+	if h.Interval < minHeartbeatInterval {
+		return fmt.Errorf("heartbeat interval of %s must be at least %s", h.Interval, minHeartbeatInterval)
+	}
+	if h.PenultimateBeforeEnd < minHeartbeatPenultimateBeforeEnd {
+		return fmt.Errorf("heartbeat penultimate-before-end of %s must be at least %s",
+			h.PenultimateBeforeEnd, minHeartbeatPenultimateBeforeEnd)
+	}
+	if h.MaxAttempts < 1 {
+		return fmt.Errorf("heartbeat max-attempts of %d must be at least 1", h.MaxAttempts)
+	}
+	if h.AttemptDelay < 0 || h.ConnRetryInterval < 0 {
+		return fmt.Errorf("heartbeat attempt-delay and connection-retry-interval can't be negative")
+	}
+	if h.ConnTimeout <= 0 {
+		return fmt.Errorf("heartbeat connection-timeout of %s must be positive", h.ConnTimeout)
+	}
+	if h.ConnMaxRetries < 0 {
+		return fmt.Errorf("heartbeat connection-max-retries of %d can't be negative", h.ConnMaxRetries)
+	}
+	if len(h.Sinks) == 0 {
+		return errors.New("heartbeat sinks can't be empty")
+	}
+	for _, sink := range h.Sinks {
+		switch sink {
+		case apiSinkName:
+		case mqttSinkName:
+			if h.MQTT.Broker == "" {
+				return errors.New("heartbeat mqtt broker must be set for the mqtt sink")
+			}
+			if h.MQTT.QoS > 2 {
+				return fmt.Errorf("heartbeat mqtt qos of %d must be 0, 1 or 2", h.MQTT.QoS)
+			}
+			if h.MQTT.Timeout <= 0 {
+				return fmt.Errorf("heartbeat mqtt timeout of %s must be positive", h.MQTT.Timeout)
+			}
+		case fileSinkName:
+			if h.File == "" {
+				return errors.New("heartbeat file must be set for the file sink")
+			}
+		case socketSinkName:
+			if h.Socket == "" {
+				return errors.New("heartbeat socket must be set for the socket sink")
+			}
+		default:
+			return fmt.Errorf("unknown heartbeat sink %q", sink)
+		}
+	}
+	return nil
 }
 
 func ParseConfig(configDir string) (*AttinyConfig, error) {
@@ -47,9 +311,51 @@ func ParseConfig(configDir string) (*AttinyConfig, error) {
 		return nil, err
 	}
 
-	w, err := window.New(
-		windows.PowerOn,
-		windows.PowerOff,
+	salt := DefaultSalt()
+	if err := rawConfig.Unmarshal(SaltKey, &salt); err != nil {
+		return nil, err
+	}
+
+	power := DefaultPower()
+	if err := rawConfig.Unmarshal(PowerKey, &power); err != nil {
+		return nil, err
+	}
+	if err := power.Validate(); err != nil {
+		return nil, err
+	}
+
+	shutdown := DefaultShutdown()
+	if err := rawConfig.Unmarshal(ShutdownKey, &shutdown); err != nil {
+		return nil, err
+	}
+	if shutdown.Timeout < 0 {
+		return nil, fmt.Errorf("shutdown timeout of %s can't be negative", shutdown.Timeout)
+	}
+
+	heartbeat := DefaultHeartbeatConfig()
+	if err := rawConfig.Unmarshal(HeartbeatKey, &heartbeat); err != nil {
+		return nil, err
+	}
+	if err := heartbeat.Validate(); err != nil {
+		return nil, err
+	}
+
+	device := config.Device{}
+	rawConfig.Unmarshal(config.DeviceKey, &device)
+
+	powerWindows := []PowerWindow{}
+	if err := rawConfig.Unmarshal(PowerWindowsKey, &powerWindows); err != nil {
+		return nil, err
+	}
+	if len(powerWindows) == 0 {
+		powerWindows = []PowerWindow{{
+			PowerOn:  windows.PowerOn,
+			PowerOff: windows.PowerOff,
+		}}
+	}
+
+	schedule, err := NewSchedule(
+		powerWindows,
 		float64(location.Latitude),
 		float64(location.Longitude))
 	if err != nil {
@@ -57,7 +363,14 @@ func ParseConfig(configDir string) (*AttinyConfig, error) {
 	}
 
 	return &AttinyConfig{
-		OnWindow: w,
-		Battery:  battery,
+		OnWindow:     schedule,
+		PowerWindows: powerWindows,
+		Location:     location,
+		Battery:      battery,
+		Salt:         salt,
+		Power:        power,
+		Shutdown:     shutdown,
+		Heartbeat:    heartbeat,
+		Device:       device,
 	}, nil
 }
@@ -0,0 +1,60 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPowerValidate(t *testing.T) {
+	assert.NoError(t, DefaultPower().Validate())
+
+	p := DefaultPower()
+	p.MinOffDuration = p.WakeLead + time.Minute
+	assert.NoError(t, p.Validate())
+	p.MinOffDuration = p.WakeLead
+	assert.Error(t, p.Validate())
+
+	p = DefaultPower()
+	p.WakeLead = 90 * time.Second
+	assert.Error(t, p.Validate())
+
+	p = DefaultPower()
+	p.WakeLead = -time.Minute
+	assert.Error(t, p.Validate())
+	// No wake lead is fine.
+	p.WakeLead = 0
+	assert.NoError(t, p.Validate())
+
+	p = DefaultPower()
+	p.WindowEndMargin = 0
+	p.InitialGracePeriod = 0
+	assert.NoError(t, p.Validate())
+	p.WindowEndMargin = -time.Second
+	assert.Error(t, p.Validate())
+
+	p = DefaultPower()
+	p.InitialGracePeriod = -time.Second
+	assert.Error(t, p.Validate())
+
+	p = DefaultPower()
+	p.UntrustedOnDuration = 0
+	assert.NoError(t, p.Validate())
+	p.UntrustedOnDuration = -time.Minute
+	assert.Error(t, p.Validate())
+
+	p = DefaultPower()
+	p.UntrustedOffDuration = 0
+	assert.Error(t, p.Validate())
+	p.UntrustedOffDuration = 90 * time.Second
+	assert.Error(t, p.Validate())
+	p.UntrustedOffDuration = (maxSleepMinutes + 1) * time.Minute
+	assert.Error(t, p.Validate())
+	p.UntrustedOffDuration = p.MinOffDuration - time.Minute
+	assert.Error(t, p.Validate())
+}
@@ -0,0 +1,53 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "time"
+
+// Clock is used for all timing so the controller can be run on virtual time
+// by the tests and the simulator.
+type Clock interface {
+	Sleep(d time.Duration)
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the real time.
+type systemClock struct {
+}
+
+func (c *systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c *systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var clock Clock = &systemClock{}
+
+// now is the time on the clock. It can be used where a func() time.Time is
+// needed and follows the clock being replaced.
+func now() time.Time {
+	return clock.Now()
+}
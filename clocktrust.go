@@ -0,0 +1,247 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/godbus/dbus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	rtcDevice = "/sys/class/rtc/rtc0"
+	rtcEpoch  = rtcDevice + "/since_epoch"
+
+	// How much the clock has to move on before the last known good time is
+	// saved again.
+	goodTimeSaveInterval = time.Hour
+)
+
+var (
+	// checkClockTrust is a variable so the simulator can replace it.
+	checkClockTrust = checkSystemClock
+
+	// clockFromATtiny is set once the system time has been set from the time
+	// kept by the ATtiny over a power off.
+	clockFromATtiny = false
+
+	// These are variables so they can be replaced when testing.
+	ntpSynced     = ntpSynchronized
+	rtcTime       = readRTC
+	setSystemTime = func(t time.Time) error {
+		tv := unix.NsecToTimeval(t.UnixNano())
+		return unix.Settimeofday(&tv)
+	}
+)
+
+// checkSystemClock returns true if the system time can be trusted for working
+// out the power schedule. The clock is trusted if it hasn't gone back past the
+// last known good time and either NTP has synchronised it, there is an RTC
+// that also hasn't gone back past the last known good time or it was set from
+// the ATtiny. If the clock isn't trusted the reason is returned.
+func checkSystemClock(now time.Time) (bool, string) {
+	var lastGood time.Time
+	state.get(func(s *persistedState) { lastGood = s.LastKnownGoodTime })
+	if now.Before(lastGood) {
+		return false, fmt.Sprintf("clock is before the last known good time of %s", lastGood.Format(time.UnixDate))
+	}
+
+	synced, err := ntpSynced()
+	if err != nil {
+		log.Printf("failed to check NTP sync: %v", err)
+	}
+	if synced {
+		return true, ""
+	}
+	rtc, rtcErr := rtcTime()
+	if rtcErr == nil && !rtc.Before(lastGood) {
+		return true, ""
+	}
+	if clockFromATtiny {
+		return true, ""
+	}
+	if rtcErr == nil {
+		return false, fmt.Sprintf("RTC time of %s is before the last known good time of %s",
+			rtc.Format(time.UnixDate), lastGood.Format(time.UnixDate))
+	}
+	return false, "clock isn't synchronised by NTP and there is no RTC"
+}
+
+// readRTC returns the time kept by the RTC, or an error if there isn't one.
+func readRTC() (time.Time, error) {
+	b, err := os.ReadFile(rtcEpoch)
+	if err != nil {
+		return time.Time{}, err
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// ntpSynchronized asks timedated if the clock is synchronised, falling back
+// to timedatectl if it can't be reached over D-Bus.
+func ntpSynchronized() (bool, error) {
+	conn, err := dbus.SystemBus()
+	if err == nil {
+		obj := conn.Object("org.freedesktop.timedate1", "/org/freedesktop/timedate1")
+		v, err := obj.GetProperty("org.freedesktop.timedate1.NTPSynchronized")
+		if synced, ok := v.Value().(bool); err == nil && ok {
+			return synced, nil
+		}
+	}
+	out, err := exec.Command("timedatectl", "show", "--property=NTPSynchronized", "--value").Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == "yes", nil
+}
+
+// clockWatcher tracks whether the clock is trusted, logging and making an
+// event when that changes.
+type clockWatcher struct {
+	checked      bool
+	trusted      bool
+	driftChecked bool
+}
+
+// check returns true if the clock can be trusted. While it is trusted the
+// current time is saved as the last known good time. The first time it is
+// trusted the wake drift is checked.
+func (w *clockWatcher) check() bool {
+	now := clock.Now()
+	trusted, reason := checkClockTrust(now)
+	if trusted {
+		if w.checked && !w.trusted {
+			log.Println("clock is now trusted, applying the power schedule")
+		}
+		saveGoodTime(now, false)
+		if !w.driftChecked {
+			w.driftChecked = true
+			checkWakeDrift(now)
+		}
+	} else if !w.checked || w.trusted {
+		log.Printf("not trusting the clock, will stay on until it is or power off on the untrusted duty cycle: %s", reason)
+		err := addEvent(eventclient.Event{
+			Timestamp: now,
+			Type:      "clock-untrusted",
+			Details: map[string]interface{}{
+				"reason": reason,
+			},
+		})
+		if err != nil {
+			log.Printf("failed to make clock-untrusted event: %v", err)
+		}
+	}
+	w.checked = true
+	w.trusted = trusted
+	return trusted
+}
+
+// saveGoodTime saves t as the last known good time. Unless force is set it is
+// only saved once the clock has moved on by goodTimeSaveInterval.
+func saveGoodTime(t time.Time, force bool) {
+	var lastGood time.Time
+	state.get(func(s *persistedState) { lastGood = s.LastKnownGoodTime })
+	if !force && t.Sub(lastGood) < goodTimeSaveInterval {
+		return
+	}
+	err := state.update(func(s *persistedState) {
+		if t.After(s.LastKnownGoodTime) {
+			s.LastKnownGoodTime = t
+		}
+	})
+	if err != nil {
+		log.Printf("failed to save last known good time: %v", err)
+	}
+}
+
+// restoreClock sets the system time from the time the ATtiny kept while the
+// Pi was powered off. This is only done after a scheduled wake if the clock
+// can't otherwise be trusted, so the ATtiny acts as a coarse RTC. The stored
+// time is cleared once read so a later boot can't reuse it.
+func restoreClock(a *attiny) {
+	if a.version < timeKeepingVersion {
+		return
+	}
+	stored, sleptMinutes, err := a.readStoredTime()
+	if err != nil {
+		log.Printf("failed to read time from attiny: %v", err)
+		return
+	}
+	if !stored.IsZero() {
+		if err := a.clearStoredTime(); err != nil {
+			log.Printf("failed to clear time stored in attiny: %v", err)
+		}
+	}
+	if a.wakeReason != wakeScheduled {
+		return
+	}
+	now := clock.Now()
+	if trusted, _ := checkClockTrust(now); trusted {
+		return
+	}
+	var lastGood time.Time
+	state.get(func(s *persistedState) { lastGood = s.LastKnownGoodTime })
+	t, ok := restoredTime(now, lastGood, stored, sleptMinutes)
+	if !ok {
+		return
+	}
+	if err := setSystemTime(t); err != nil {
+		log.Printf("failed to set time from attiny: %v", err)
+		return
+	}
+	clockFromATtiny = true
+	log.Printf("set time from attiny to %s (was %s)", t.Format(time.UnixDate), now.Format(time.UnixDate))
+	err = addEvent(eventclient.Event{
+		Timestamp: t,
+		Type:      "clock-set-from-attiny",
+		Details: map[string]interface{}{
+			"storedTime":   stored,
+			"sleptMinutes": sleptMinutes,
+			"previousTime": now,
+		},
+	})
+	if err != nil {
+		log.Printf("failed to make clock-set-from-attiny event: %v", err)
+	}
+}
+
+// restoredTime works out the time from what was stored in the ATtiny before
+// powering off and how long it has slept for since. The time is only used if
+// it moves the clock forward and isn't before the last known good time.
+func restoredTime(now, lastGood, stored time.Time, sleptMinutes int) (time.Time, bool) {
+	if stored.IsZero() {
+		return time.Time{}, false
+	}
+	t := stored.Add(time.Duration(sleptMinutes) * time.Minute)
+	if !t.After(now) || t.Before(lastGood) {
+		return time.Time{}, false
+	}
+	return t, true
+}
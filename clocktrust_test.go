@@ -0,0 +1,180 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSystemClock(t *testing.T) {
+	now := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		lastGood   time.Time
+		ntp        bool
+		ntpErr     error
+		rtc        bool
+		rtcTime    time.Time
+		fromATtiny bool
+		want       bool
+	}{
+		{name: "ntp", ntp: true, want: true},
+		{name: "rtc", rtc: true, want: true},
+		{name: "attiny", fromATtiny: true, want: true},
+		{name: "untrusted"},
+		{name: "ntp error with rtc", ntpErr: errors.New("no timedated"), rtc: true, want: true},
+		{name: "ntp error", ntpErr: errors.New("no timedated")},
+		{name: "before last good time", lastGood: now.Add(time.Hour), ntp: true, rtc: true},
+		{name: "rtc after last good time", lastGood: now.Add(-time.Hour), rtc: true, rtcTime: now, want: true},
+		{name: "rtc before last good time", lastGood: now.Add(-time.Hour), rtc: true, rtcTime: now.Add(-2 * time.Hour)},
+		{name: "rtc before last good time but ntp", lastGood: now.Add(-time.Hour), ntp: true, rtc: true, rtcTime: now.Add(-2 * time.Hour), want: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			restoreGlobals(t)
+			state = &persistedState{LastKnownGoodTime: tc.lastGood}
+			ntpSynced = func() (bool, error) { return tc.ntp, tc.ntpErr }
+			rtcTime = func() (time.Time, error) {
+				if !tc.rtc {
+					return time.Time{}, errors.New("no rtc")
+				}
+				return tc.rtcTime, nil
+			}
+			clockFromATtiny = tc.fromATtiny
+
+			trusted, reason := checkSystemClock(now)
+			assert.Equal(t, tc.want, trusted)
+			assert.Equal(t, tc.want, reason == "")
+		})
+	}
+}
+
+func TestClockWatcherCheck(t *testing.T) {
+	restoreGlobals(t)
+	c := &simClock{now: time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)}
+	trusted := false
+	var events []string
+	uptimeReads := 0
+	statePath = ""
+	state = &persistedState{Cycle: &cycleRecord{
+		ExpectedWake: c.now.Add(-time.Hour),
+		WakeReason:   wakeScheduled.String(),
+	}}
+	clock = c
+	checkClockTrust = func(time.Time) (bool, string) { return trusted, "test" }
+	addEvent = func(e eventclient.Event) error {
+		events = append(events, e.Type)
+		return nil
+	}
+	systemUptime = func() (time.Duration, error) {
+		uptimeReads++
+		return time.Hour, nil
+	}
+
+	w := clockWatcher{}
+	assert.False(t, w.check())
+	c.Sleep(time.Minute)
+	assert.False(t, w.check())
+	assert.Equal(t, []string{"clock-untrusted"}, events, "clock-untrusted event only made once")
+	assert.True(t, state.LastKnownGoodTime.IsZero())
+	assert.Zero(t, uptimeReads)
+
+	trusted = true
+	c.Sleep(time.Minute)
+	assert.True(t, w.check())
+	assert.Equal(t, c.Now(), state.LastKnownGoodTime)
+	assert.Equal(t, 1, uptimeReads)
+
+	c.Sleep(goodTimeSaveInterval)
+	assert.True(t, w.check())
+	assert.Equal(t, c.Now(), state.LastKnownGoodTime)
+	assert.Equal(t, 1, uptimeReads, "drift only checked once")
+
+	trusted = false
+	assert.False(t, w.check())
+	assert.Equal(t, []string{"clock-untrusted", "clock-untrusted"}, events)
+}
+
+func TestRestoredTime(t *testing.T) {
+	stored := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+	bootTime := time.Date(2026, 5, 30, 0, 0, 0, 0, time.UTC)
+
+	restored, ok := restoredTime(bootTime, stored.Add(-time.Hour), stored, 600)
+	assert.True(t, ok)
+	assert.Equal(t, stored.Add(10*time.Hour), restored)
+
+	// No time stored.
+	_, ok = restoredTime(bootTime, time.Time{}, time.Time{}, 600)
+	assert.False(t, ok)
+
+	// Would move the clock backwards.
+	_, ok = restoredTime(stored.Add(11*time.Hour), time.Time{}, stored, 600)
+	assert.False(t, ok)
+
+	// Before the last known good time.
+	_, ok = restoredTime(bootTime, stored.Add(11*time.Hour), stored, 600)
+	assert.False(t, ok)
+}
+
+func TestRestoreClock(t *testing.T) {
+	now := time.Date(2026, 5, 30, 0, 0, 0, 0, time.UTC)
+	stored := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		reason  wakeReason
+		trusted bool
+		want    bool
+	}{
+		{name: "scheduled wake", reason: wakeScheduled, want: true},
+		{name: "trusted clock", reason: wakeScheduled, trusted: true},
+		{name: "power restored", reason: wakePowerRestored},
+		{name: "watchdog", reason: wakeWatchdog},
+		{name: "button", reason: wakeButton},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			restoreGlobals(t)
+			clock = &simClock{now: now}
+			state = &persistedState{}
+			checkClockTrust = func(time.Time) (bool, string) { return tc.trusted, "" }
+			addEvent = func(eventclient.Event) error { return nil }
+			var set []time.Time
+			setSystemTime = func(t time.Time) error {
+				set = append(set, t)
+				return nil
+			}
+
+			a, _ := newFakeATtiny(timeKeepingVersion)
+			a.wakeReason = tc.reason
+			assert.NoError(t, a.storeTime(stored))
+			assert.NoError(t, a.write(sleptMinutesReg, []byte{0, 60}))
+
+			restoreClock(a)
+			if tc.want {
+				assert.Len(t, set, 1)
+				assert.True(t, stored.Add(time.Hour).Equal(set[0]))
+			} else {
+				assert.Empty(t, set)
+			}
+			assert.Equal(t, tc.want, clockFromATtiny)
+
+			// The stored time is cleared either way so it isn't used again
+			// on the next boot.
+			readTime, _, err := a.readStoredTime()
+			assert.NoError(t, err)
+			assert.True(t, readTime.IsZero())
+			set = nil
+			a.wakeReason = wakeScheduled
+			clockFromATtiny = false
+			restoreClock(a)
+			assert.Empty(t, set)
+		})
+	}
+}
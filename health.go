@@ -0,0 +1,112 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/go-config"
+	"golang.org/x/sys/unix"
+)
+
+const diskUsagePath = "/"
+
+// healthATtiny is the ATtiny health is read from. It is set once connected.
+var healthATtiny *attiny
+
+// sendHealthEvent makes a device-health event to go with a new heartbeat and
+// uploads it straight away, while there is a connection.
+func sendHealthEvent(validUntil time.Time) {
+	details := deviceHealth(healthATtiny)
+	details["validUntil"] = validUntil
+	err := addEvent(eventclient.Event{
+		Timestamp: clock.Now(),
+		Type:      "device-health",
+		Details:   details,
+	})
+	if err != nil {
+		log.Printf("failed to make device-health event: %v", err)
+		return
+	}
+	if err := uploadEvents(); err != nil {
+		log.Printf("failed to upload device-health event: %v", err)
+	}
+}
+
+// deviceHealth collects what is known about the device's health. Anything
+// that can't be read is left out.
+func deviceHealth(a *attiny) map[string]interface{} {
+	health := map[string]interface{}{}
+	if uptime, err := systemUptime(); err == nil {
+		health["uptimeSeconds"] = int64(uptime / time.Second)
+	}
+	if used, err := diskUsedPercent(diskUsagePath); err == nil {
+		health["diskUsedPercent"] = used
+	}
+	if a == nil {
+		return health
+	}
+	health["attinyVersion"] = a.version
+	health["wakeReason"] = a.wakeReason.String()
+	if onBattery, err := a.checkIsOnBattery(); err == nil {
+		health["onBattery"] = onBattery
+	}
+	if !a.battery.EnableVoltageReadings {
+		return health
+	}
+	// The ATtiny's raw ADC reading of the battery sense pin, in the same
+	// units as the battery readings in the config. There is nothing to
+	// convert it to volts with as that depends on the board.
+	if reading, err := a.readBatteryValue(); err == nil {
+		health["batteryRawADC"] = reading
+		if percent, ok := batteryPercent(reading, a.battery); ok {
+			health["batteryPercent"] = percent
+		}
+	}
+	return health
+}
+
+// batteryPercent works out how full the battery is from a battery reading,
+// using the configured low and full readings.
+func batteryPercent(reading uint16, battery config.Battery) (float64, bool) {
+	if battery.FullBattery <= battery.LowBattery {
+		return 0, false
+	}
+	percent := float64(int(reading)-int(battery.LowBattery)) /
+		float64(battery.FullBattery-battery.LowBattery) * 100
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	return percent, true
+}
+
+func diskUsedPercent(path string) (float64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+	return float64(stat.Blocks-stat.Bfree) / float64(stat.Blocks) * 100, nil
+}
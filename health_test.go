@@ -0,0 +1,60 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/TheCacophonyProject/go-config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatteryPercent(t *testing.T) {
+	battery := config.Battery{LowBattery: 400, FullBattery: 600}
+	percent, ok := batteryPercent(500, battery)
+	assert.True(t, ok)
+	assert.Equal(t, 50.0, percent)
+
+	percent, _ = batteryPercent(300, battery)
+	assert.Equal(t, 0.0, percent)
+	percent, _ = batteryPercent(700, battery)
+	assert.Equal(t, 100.0, percent)
+
+	_, ok = batteryPercent(500, config.Battery{})
+	assert.False(t, ok)
+}
+
+func TestDeviceHealthWithoutATtiny(t *testing.T) {
+	health := deviceHealth(nil)
+	assert.Contains(t, health, "uptimeSeconds")
+	assert.Contains(t, health, "diskUsedPercent")
+	assert.NotContains(t, health, "attinyVersion")
+}
+
+func TestDeviceHealth(t *testing.T) {
+	a, bus := newFakeATtiny(timeKeepingVersion)
+	a.wakeReason = wakeScheduled
+	a.battery = config.Battery{
+		EnableVoltageReadings: true,
+		NoBattery:             100,
+		LowBattery:            400,
+		FullBattery:           600,
+	}
+	bus.regs[batteryVoltageHiReg], bus.regs[batteryVoltageLoReg] = 0x01, 0xf4
+
+	health := deviceHealth(a)
+	assert.Equal(t, uint8(timeKeepingVersion), health["attinyVersion"])
+	assert.Equal(t, "scheduled", health["wakeReason"])
+	assert.Equal(t, true, health["onBattery"])
+	assert.Equal(t, uint16(500), health["batteryRawADC"])
+	assert.Equal(t, 50.0, health["batteryPercent"])
+
+	// Without voltage readings the battery is left out.
+	a, _ = newFakeATtiny(timeKeepingVersion)
+	health = deviceHealth(a)
+	assert.Equal(t, false, health["onBattery"])
+	assert.NotContains(t, health, "batteryRawADC")
+	assert.NotContains(t, health, "batteryPercent")
+}
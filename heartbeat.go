@@ -1,106 +1,123 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
-	api "github.com/TheCacophonyProject/go-api"
-	"github.com/TheCacophonyProject/modemd/connrequester"
 	"github.com/TheCacophonyProject/modemd/modemlistener"
-	"github.com/TheCacophonyProject/window"
-)
-
-const (
-	heartBeatDelay = 30 * time.Minute
-	interval       = 4 * time.Hour
-	attemptDelay   = 5 * time.Second
-
-	connTimeout       = time.Minute * 2
-	connRetryInterval = time.Minute * 1
-	connMaxRetries    = 3
 )
 
 type Heartbeat struct {
-	api         *api.CacophonyAPI
-	window      *window.Window
+	window      *Schedule
 	validUntil  time.Time
 	end         time.Time
 	penultimate bool
+	// alwaysOn is set when there is no window. Heartbeats are then sent
+	// forever, each valid for the interval from when it is sent.
+	alwaysOn    bool
 	MaxAttempts int
+	clock       Clock
+	conf        HeartbeatConfig
+	observer    heartbeatObserver
 }
 
-// Used to test
-type Clock interface {
-	Sleep(d time.Duration)
-	Now() time.Time
-	After(d time.Duration) <-chan time.Time
-}
+// heartbeatConf is set from the config on startup.
+var heartbeatConf = DefaultHeartbeatConfig()
 
-type HeartBeatClock struct {
-}
+// These are variables so the simulator can replace them.
+var (
+	heartbeatSender         = sendHeartbeat
+	getModemConnectedSignal = modemlistener.GetModemConnectedSignalListener
+)
 
-func (h *HeartBeatClock) Sleep(d time.Duration) {
-	time.Sleep(d)
-}
-func (h *HeartBeatClock) Now() time.Time {
-	return time.Now()
+func heartBeatLoop(ctx context.Context, window *Schedule, observer heartbeatObserver) {
+	hb := NewHeartbeat(window)
+	hb.observer = observer
+	sendBeats(ctx, hb, window)
 }
 
-func (h *HeartBeatClock) After(d time.Duration) <-chan time.Time {
-	return time.After(d)
+// heartbeatObserver is told what a heartbeat loop is doing.
+type heartbeatObserver interface {
+	beatSent(validUntil time.Time, err error)
+	nextBeatAt(t time.Time)
 }
 
-var clock Clock = &HeartBeatClock{}
-
-func heartBeatLoop(window *window.Window) {
-	hb := NewHeartbeat(window)
-	sendBeats(hb, window)
-}
-func sendBeats(hb *Heartbeat, window *window.Window) {
-	modemConnectSignal, err := modemlistener.GetModemConnectedSignalListener()
+// sendBeats sends heartbeats through the window until the final one is sent
+// or ctx is cancelled.
+func sendBeats(ctx context.Context, hb *Heartbeat, window *Schedule) {
+	modemConnectSignal, err := getModemConnectedSignal()
 	if err != nil {
 		log.Println("Failed to get modem connected signal listener")
 	}
-	initialDelay := heartBeatDelay
-
-	if !window.Active() {
-		until := window.Until()
-		if until > initialDelay {
-			initialDelay = until
-		}
-	}
+	replayQueuedHeartbeats(ctx, hb.MaxAttempts, heartbeatSinks)
+	initialDelay := hb.initialDelay()
 	log.Printf("Sending initial heartbeat in %v", initialDelay)
-	clock.Sleep(initialDelay)
+	hb.notifyNextBeat(hb.clock.Now().Add(initialDelay))
+	select {
+	case <-ctx.Done():
+		return
+	case <-hb.clock.After(initialDelay):
+	}
 	for {
 		done := hb.updateNextBeat()
-		err := sendHeartbeat(hb.validUntil, hb.MaxAttempts)
+		err := sendOrQueueHeartbeat(ctx, hb.validUntil, hb.MaxAttempts)
 		if err != nil {
-			log.Printf("Error sending heartbeat, skipping this beat %v", err)
+			log.Printf("Error sending heartbeat, queued to send later %v", err)
+		}
+		if hb.observer != nil {
+			hb.observer.beatSent(hb.validUntil, err)
 		}
 		if done {
 			log.Printf("Sent penultimate heartbeat")
 			return
 		}
 
-		nextEventIn := hb.validUntil.Sub(clock.Now())
-		if !hb.penultimate && nextEventIn >= 2*time.Hour {
-			nextEventIn = nextEventIn - 1*time.Hour
-		} else {
-			// 5 minutes to give a bit of leeway
-			nextEventIn = nextEventIn - 5*time.Minute
-
-		}
-		log.Printf("Heartbeat sleeping until %v", clock.Now().Add(nextEventIn))
+		nextEventIn := hb.untilNextBeat()
+		log.Printf("Heartbeat sleeping until %v", hb.clock.Now().Add(nextEventIn))
+		hb.notifyNextBeat(hb.clock.Now().Add(nextEventIn))
 		// Empty modemConnectSignal channel so as to not trigger from old signals
 		emptyChannel(modemConnectSignal)
 		select {
+		case <-ctx.Done():
+			return
 		case <-modemConnectSignal:
+			// Sending the next beat also sends any queued heartbeat.
 			log.Println("Modem connected")
-		case <-clock.After(nextEventIn):
+		case <-hb.clock.After(nextEventIn):
 		}
 	}
 }
 
+func (h *Heartbeat) notifyNextBeat(t time.Time) {
+	if h.observer != nil {
+		h.observer.nextBeatAt(t)
+	}
+}
+
+// initialDelay is how long to wait before sending the first heartbeat.
+func (h *Heartbeat) initialDelay() time.Duration {
+	initialDelay := h.conf.InitialDelay
+	if !h.window.Active() {
+		until := h.window.Until()
+		if until > initialDelay {
+			initialDelay = until
+		}
+	}
+	return initialDelay
+}
+
+// untilNextBeat is how long to wait after sending a heartbeat before sending
+// the next one.
+func (h *Heartbeat) untilNextBeat() time.Duration {
+	nextEventIn := h.validUntil.Sub(h.clock.Now())
+	if !h.penultimate && nextEventIn >= 2*time.Hour {
+		return nextEventIn - 1*time.Hour
+	}
+	// 5 minutes to give a bit of leeway
+	return nextEventIn - 5*time.Minute
+}
+
 func emptyChannel(ch chan time.Time) {
 	for {
 		select {
@@ -111,27 +128,39 @@ func emptyChannel(ch chan time.Time) {
 	}
 }
 
-func NewHeartbeat(window *window.Window) *Heartbeat {
+func NewHeartbeat(window *Schedule) *Heartbeat {
 	var nextEnd time.Time
 	if !window.NoWindow {
 		nextEnd = window.NextEnd()
 	}
 
-	h := &Heartbeat{end: nextEnd, window: window, MaxAttempts: 3}
+	h := &Heartbeat{
+		end:         nextEnd,
+		window:      window,
+		alwaysOn:    window.NoWindow,
+		MaxAttempts: heartbeatConf.MaxAttempts,
+		clock:       clock,
+		conf:        heartbeatConf,
+	}
 	return h
 }
 
 //updates next heart beat time, returns true if will be the final event
 func (h *Heartbeat) updateNextBeat() bool {
+	if h.alwaysOn {
+		h.validUntil = h.clock.Now().Add(h.conf.Interval)
+		return false
+	}
 	if h.penultimate {
 		h.validUntil = h.end
 		return true
 	}
-	h.validUntil = clock.Now().Add(interval)
-	if !h.window.NoWindow && h.validUntil.After(h.end.Add(-time.Hour)) {
-		// always want an event 1 hour before end if possible
-		h.validUntil = h.end.Add(-time.Hour)
-		if clock.Now().After(h.validUntil) {
+	h.validUntil = h.clock.Now().Add(h.conf.Interval)
+	penultimate := h.end.Add(-h.conf.PenultimateBeforeEnd)
+	if h.validUntil.After(penultimate) {
+		// always want an event PenultimateBeforeEnd before end if possible
+		h.validUntil = penultimate
+		if h.clock.Now().After(h.validUntil) {
 			// rare case of very short window
 			h.validUntil = h.end
 			return true
@@ -141,50 +170,13 @@ func (h *Heartbeat) updateNextBeat() bool {
 	return false
 }
 
-func sendHeartbeat(nextBeat time.Time, attempts int) error {
-	cr := connrequester.NewConnectionRequester()
-	cr.Start()
-	defer cr.Stop()
-	if err := cr.WaitUntilUpLoop(connTimeout, connRetryInterval, connMaxRetries); err != nil {
-		log.Println("unable to get an internet connection. Not reporting events")
-		return err
-	}
-	var apiClient *api.CacophonyAPI
-	var err error
-	attempt := 0
-	for {
-		apiClient, err = api.New()
-		if err != nil {
-			attempt += 1
-			if attempt < attempts {
-				log.Printf("Error connecting to api %v trying again in %v", err, attemptDelay)
-				clock.Sleep(attemptDelay)
-				continue
-			}
-			log.Printf("Error connecting to api %v", err)
-			return err
-		}
-		break
-	}
-
-	attempt = 0
-	for {
-		_, err := apiClient.Heartbeat(nextBeat)
-		if err == nil {
-			log.Printf("Sent heartbeat, valid until %v", nextBeat)
-			return nil
-		}
-		attempt += 1
-		if attempt > attempts {
-			break
-		}
-		log.Printf("Error sending heartbeat %v, trying again in %v", err, attemptDelay)
-		clock.Sleep(attemptDelay)
-	}
-	return err
+func sendFinalHeartBeat(window *Schedule) error {
+	log.Printf("Sending final heart beat")
+	return sendOrQueueHeartbeat(context.Background(), finalHeartbeatValidUntil(window), heartbeatConf.MaxAttempts)
 }
 
-func sendFinalHeartBeat(window *window.Window) error {
-	log.Printf("Sending final heart beat")
-	return sendHeartbeat(window.NextStart().Add(heartBeatDelay*2), 3)
+// finalHeartbeatValidUntil is how long the heartbeat sent before powering off
+// at the end of the window is valid for.
+func finalHeartbeatValidUntil(window *Schedule) time.Time {
+	return window.NextStart().Add(heartbeatConf.InitialDelay * 2)
 }
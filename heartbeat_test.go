@@ -5,13 +5,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-
-	"github.com/TheCacophonyProject/window"
 )
 
 const dateFormat = "15:04"
@@ -64,7 +64,7 @@ func (h *TestClock) After(d time.Duration) <-chan time.Time {
 
 func TestSmallWindow(t *testing.T) {
 	clock := &TestClock{now: time.Now(), t: t}
-	w, err := window.New(clock.Now().Format(dateFormat), clock.Now().Add(time.Hour).Format(dateFormat), 0, 0)
+	w, err := newTestSchedule(clock.Now(), clock.Now().Add(time.Hour))
 	sleeps := make([]time.Time, 1)
 	sleeps[0] = clock.now.Add(30 * time.Minute)
 
@@ -74,7 +74,7 @@ func TestSmallWindow(t *testing.T) {
 }
 func TestShortDelay(t *testing.T) {
 	clock := &TestClock{now: time.Now(), t: t}
-	w, err := window.New(clock.Now().Add(10*time.Minute).Format(dateFormat), clock.Now().Add(4*time.Hour).Format(dateFormat), 0, 0)
+	w, err := newTestSchedule(clock.Now().Add(10*time.Minute), clock.Now().Add(4*time.Hour))
 	sleeps := make([]time.Time, 2, 2)
 	sleeps[0] = clock.now.Add(30 * time.Minute)
 	sleeps[1] = w.NextEnd().Add(-65 * time.Minute)
@@ -86,10 +86,10 @@ func TestShortDelay(t *testing.T) {
 
 func TestLongDelay(t *testing.T) {
 	clock := &TestClock{now: time.Now(), t: t}
-	w, err := window.New(clock.Now().Add(time.Hour).Format(dateFormat), clock.Now().Add(4*time.Hour).Format(dateFormat), 0, 0)
+	w, err := newTestSchedule(clock.Now().Add(time.Hour), clock.Now().Add(4*time.Hour))
 	sleeps := make([]time.Time, 2, 2)
 	// expect delay until window starts if further than 30 minutes
-	sleeps[0] = clock.Now().Add(w.Until())
+	sleeps[0] = w.NextStart()
 	sleeps[1] = w.NextEnd().Add(-65 * time.Minute)
 
 	clock.expectedSleeps = sleeps
@@ -99,7 +99,7 @@ func TestLongDelay(t *testing.T) {
 
 func TestWindow(t *testing.T) {
 	clock := &TestClock{now: time.Now(), t: t}
-	w, err := window.New(clock.Now().Format(dateFormat), clock.Now().Add(9*time.Hour).Format(dateFormat), 0, 0)
+	w, err := newTestSchedule(clock.Now(), clock.Now().Add(9*time.Hour))
 	sleeps := make([]time.Time, 4, 4)
 	sleeps[0] = clock.now.Add(30 * time.Minute)
 	sleeps[1] = sleeps[0].Add(3 * time.Hour)
@@ -111,13 +111,233 @@ func TestWindow(t *testing.T) {
 	heartBeatTestLoop(w, clock)
 }
 
-func heartBeatTestLoop(window *window.Window, timer *TestClock) {
+func newTestSchedule(powerOn, powerOff time.Time) (*Schedule, error) {
+	return NewSchedule([]PowerWindow{{
+		PowerOn:  powerOn.Format(dateFormat),
+		PowerOff: powerOff.Format(dateFormat),
+	}}, 0, 0)
+}
+
+func heartBeatTestLoop(window *Schedule, timer *TestClock) {
+	restoreGlobals(timer.t)
+	statePath = ""
 	clock = timer
 	hb := NewHeartbeat(window)
 	hb.MaxAttempts = 1
 	timer.hb = hb
-	sendBeats(hb, window)
+	sendBeats(context.Background(), hb, window)
 	assert.Equal(timer.t, timer.sleepCount, len(timer.expectedSleeps), "Missing sleep events")
 	// assert last beat is at end
 	assert.Equal(timer.t, window.NextEnd().Format(dateFormat), hb.validUntil.Format(dateFormat))
 }
+
+func TestHeartbeatQueue(t *testing.T) {
+	restoreGlobals(t)
+	now := time.Now()
+	clock = &simClock{now: now}
+	statePath = ""
+	state = &persistedState{}
+	online := false
+	sent := []time.Time{}
+	heartbeatSender = func(ctx context.Context, validUntil time.Time, attempts int, sinks []heartbeatSink) error {
+		if !online {
+			return errors.New("no connection")
+		}
+		sent = append(sent, validUntil)
+		return nil
+	}
+
+	// Failed heartbeats collapse to the one valid for longest.
+	assert.Error(t, sendOrQueueHeartbeat(context.Background(), now.Add(4*time.Hour), 1))
+	assert.Error(t, sendOrQueueHeartbeat(context.Background(), now.Add(8*time.Hour), 1))
+	assert.Error(t, sendOrQueueHeartbeat(context.Background(), now.Add(2*time.Hour), 1))
+	assert.Equal(t, now.Add(8*time.Hour), state.QueuedHeartbeats[apiSinkName])
+
+	// Once online the queued heartbeat is sent. It is valid for longer so
+	// the new one isn't needed.
+	online = true
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), now.Add(4*time.Hour), 1))
+	assert.Equal(t, []time.Time{now.Add(8 * time.Hour)}, sent)
+	assert.True(t, state.QueuedHeartbeats[apiSinkName].IsZero())
+
+	// A shorter queued heartbeat is sent before the new one.
+	sent = nil
+	queueHeartbeat(apiSink{}, now.Add(2*time.Hour))
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), now.Add(4*time.Hour), 1))
+	assert.Equal(t, []time.Time{now.Add(2 * time.Hour), now.Add(4 * time.Hour)}, sent)
+	assert.True(t, state.QueuedHeartbeats[apiSinkName].IsZero())
+
+	// Expired heartbeats are dropped.
+	sent = nil
+	queueHeartbeat(apiSink{}, now.Add(-time.Minute))
+	replayQueuedHeartbeats(context.Background(), 1, heartbeatSinks)
+	assert.Empty(t, sent)
+	assert.True(t, state.QueuedHeartbeats[apiSinkName].IsZero())
+}
+
+func plannedBeatsWith(t *testing.T, conf HeartbeatConfig) []time.Time {
+	restoreGlobals(t)
+	heartbeatConf = conf
+	c := &simClock{now: at(18, 0)}
+	w := newScheduleAt(t, at(18, 0), PowerWindow{PowerOn: "18:00", PowerOff: "06:00"})
+	w.Now = c.Now
+	return plannedHeartbeats(w, c)
+}
+
+func TestHourlyHeartbeats(t *testing.T) {
+	conf := DefaultHeartbeatConfig()
+	conf.InitialDelay = 10 * time.Minute
+	conf.Interval = time.Hour
+	conf.PenultimateBeforeEnd = 30 * time.Minute
+	require.NoError(t, conf.Validate())
+
+	beats := plannedBeatsWith(t, conf)
+	require.True(t, len(beats) > 3)
+	assert.Equal(t, at(19, 10), beats[0])
+	// Sent 5 minutes before the last one expires.
+	assert.Equal(t, at(20, 5), beats[1])
+	assert.Equal(t, at(29, 30), beats[len(beats)-2])
+	assert.Equal(t, at(30, 0), beats[len(beats)-1])
+	for i := 1; i < len(beats); i++ {
+		assert.True(t, beats[i].Sub(beats[i-1]) <= time.Hour)
+	}
+}
+
+func TestTwelveHourHeartbeats(t *testing.T) {
+	conf := DefaultHeartbeatConfig()
+	conf.Interval = 12 * time.Hour
+	require.NoError(t, conf.Validate())
+
+	beats := plannedBeatsWith(t, conf)
+	assert.Equal(t, []time.Time{at(29, 0), at(30, 0)}, beats)
+}
+
+func TestHeartbeatConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultHeartbeatConfig().Validate())
+
+	invalid := []func(c *HeartbeatConfig){
+		func(c *HeartbeatConfig) { c.InitialDelay = -time.Minute },
+		func(c *HeartbeatConfig) { c.Interval = minHeartbeatInterval - time.Minute },
+		func(c *HeartbeatConfig) { c.PenultimateBeforeEnd = 5 * time.Minute },
+		func(c *HeartbeatConfig) { c.MaxAttempts = 0 },
+		func(c *HeartbeatConfig) { c.AttemptDelay = -time.Second },
+		func(c *HeartbeatConfig) { c.ConnTimeout = 0 },
+		func(c *HeartbeatConfig) { c.ConnMaxRetries = -1 },
+		func(c *HeartbeatConfig) { c.Sinks = nil },
+		func(c *HeartbeatConfig) { c.Sinks = []string{"carrier-pigeon"} },
+		func(c *HeartbeatConfig) { c.Sinks = []string{mqttSinkName} },
+		func(c *HeartbeatConfig) { c.Sinks = []string{fileSinkName} },
+		func(c *HeartbeatConfig) { c.Sinks = []string{socketSinkName} },
+		func(c *HeartbeatConfig) {
+			c.Sinks = []string{mqttSinkName}
+			c.MQTT.Broker = "tcp://localhost:1883"
+			c.MQTT.QoS = 3
+		},
+	}
+	for i, f := range invalid {
+		c := DefaultHeartbeatConfig()
+		f(&c)
+		assert.Error(t, c.Validate(), "case %d", i)
+	}
+
+	c := DefaultHeartbeatConfig()
+	c.Interval = minHeartbeatInterval
+	c.PenultimateBeforeEnd = minHeartbeatPenultimateBeforeEnd
+	assert.NoError(t, c.Validate())
+}
+
+type sentBeat struct {
+	at, validUntil time.Time
+}
+
+// beatRecorder records the heartbeats a loop reports and what was queued for
+// the API sink after each.
+type beatRecorder struct {
+	errs   []error
+	queued []time.Time
+}
+
+func (r *beatRecorder) beatSent(validUntil time.Time, err error) {
+	r.errs = append(r.errs, err)
+	r.queued = append(r.queued, state.QueuedHeartbeats[apiSinkName])
+}
+
+func (r *beatRecorder) nextBeatAt(time.Time) {}
+
+// alwaysOnBeats runs the heartbeat loop with no window until n heartbeats have
+// been attempted. A heartbeat fails if fail returns true for it.
+func alwaysOnBeats(t *testing.T, conf HeartbeatConfig, n int, fail func(i int) bool) ([]sentBeat, *beatRecorder) {
+	restoreGlobals(t)
+	c := &simClock{now: at(12, 0)}
+	clock = c
+	heartbeatConf = conf
+	statePath = ""
+	state = &persistedState{}
+	getModemConnectedSignal = func() (chan time.Time, error) {
+		return make(chan time.Time), nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	beats := []sentBeat{}
+	heartbeatSender = func(ctx context.Context, validUntil time.Time, attempts int, sinks []heartbeatSink) error {
+		if len(beats) >= n {
+			cancel()
+			return nil
+		}
+		beats = append(beats, sentBeat{c.Now(), validUntil})
+		if fail != nil && fail(len(beats)-1) {
+			return errors.New("no connection")
+		}
+		return nil
+	}
+	defer cancel()
+
+	recorder := &beatRecorder{}
+	heartBeatLoop(ctx, &Schedule{NoWindow: true, Now: c.Now}, recorder)
+	require.Len(t, beats, n)
+	return beats, recorder
+}
+
+func TestAlwaysOnHeartbeats(t *testing.T) {
+	beats, _ := alwaysOnBeats(t, DefaultHeartbeatConfig(), 4, nil)
+	assert.Equal(t, []sentBeat{
+		{at(12, 30), at(16, 30)},
+		// Each is sent an hour before the last one expires.
+		{at(15, 30), at(19, 30)},
+		{at(18, 30), at(22, 30)},
+		{at(21, 30), at(25, 30)},
+	}, beats)
+}
+
+func TestAlwaysOnShortInterval(t *testing.T) {
+	conf := DefaultHeartbeatConfig()
+	conf.Interval = 30 * time.Minute
+	conf.InitialDelay = 15 * time.Minute
+	require.NoError(t, conf.Validate())
+
+	beats, _ := alwaysOnBeats(t, conf, 3, nil)
+	assert.Equal(t, []sentBeat{
+		{at(12, 15), at(12, 45)},
+		// Sent 5 minutes before the last one expires.
+		{at(12, 40), at(13, 10)},
+		{at(13, 5), at(13, 35)},
+	}, beats)
+}
+
+func TestAlwaysOnHeartbeatFails(t *testing.T) {
+	beats, recorder := alwaysOnBeats(t, DefaultHeartbeatConfig(), 5, func(i int) bool { return i == 1 })
+	assert.Equal(t, []sentBeat{
+		{at(12, 30), at(16, 30)},
+		{at(15, 30), at(19, 30)},
+		// The failed heartbeat is sent again at the next beat, before the
+		// new one.
+		{at(18, 30), at(19, 30)},
+		{at(18, 30), at(22, 30)},
+		{at(21, 30), at(25, 30)},
+	}, beats)
+
+	// The failure is reported and the heartbeat queued until it is sent.
+	// The loop may report more beats once it is cancelled.
+	require.GreaterOrEqual(t, len(recorder.errs), 4)
+	assert.Equal(t, []error{nil, errors.New("no connection"), nil, nil}, recorder.errs[:4])
+	assert.Equal(t, []time.Time{{}, at(19, 30), {}, {}}, recorder.queued[:4])
+}
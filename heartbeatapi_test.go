@@ -0,0 +1,276 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeAPIPassword = "secret"
+	fakeAPIToken    = "JWT fake-token"
+)
+
+// fakeAPI emulates the device authentication and heartbeat endpoints of the
+// Cacophony API.
+type fakeAPI struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// failHeartbeats is how many heartbeat requests to fail before
+	// accepting them.
+	failHeartbeats int
+	authRequests   int
+	requests       int
+	heartbeats     []time.Time
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	f := &fakeAPI{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authenticate_device", f.authenticate)
+	mux.HandleFunc("/api/v1/devices/heartbeat", f.heartbeat)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeAPI) authenticate(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.authRequests++
+	var req struct {
+		DeviceName string `json:"devicename"`
+		Password   string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password != fakeAPIPassword {
+		http.Error(w, `{"success": false, "messages": ["wrong password"]}`, http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "token": fakeAPIToken})
+}
+
+func (f *fakeAPI) heartbeat(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if r.Header.Get("Authorization") != fakeAPIToken {
+		http.Error(w, `{"success": false}`, http.StatusUnauthorized)
+		return
+	}
+	if f.failHeartbeats > 0 {
+		f.failHeartbeats--
+		http.Error(w, `{"success": false}`, http.StatusInternalServerError)
+		return
+	}
+	var req struct {
+		NextHeartbeat time.Time `json:"nextHeartbeat"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.heartbeats = append(f.heartbeats, req.NextHeartbeat.Local())
+	w.Write([]byte(`{"success": true}`))
+}
+
+func (f *fakeAPI) received() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Time{}, f.heartbeats...)
+}
+
+// fakeAPIClient talks to the fake API the way the go-api client does,
+// authenticating when it is made.
+type fakeAPIClient struct {
+	url   string
+	token string
+}
+
+func newFakeAPIClient(url, password string) (*fakeAPIClient, error) {
+	body, _ := json.Marshal(map[string]string{"devicename": "test-device", "password": password})
+	resp, err := http.Post(url+"/authenticate_device", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authentication failed: %s", resp.Status)
+	}
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &fakeAPIClient{url: url, token: res.Token}, nil
+}
+
+func (c *fakeAPIClient) Heartbeat(nextHeartBeat time.Time) ([]byte, error) {
+	body, _ := json.Marshal(map[string]time.Time{"nextHeartbeat": nextHeartBeat})
+	req, err := http.NewRequest(http.MethodPost, c.url+"/api/v1/devices/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	b.ReadFrom(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("heartbeat failed: %s", resp.Status)
+	}
+	return b.Bytes(), nil
+}
+
+// fakeConnRequester fails to bring up a connection while down is set.
+type fakeConnRequester struct {
+	down    bool
+	started int
+	stopped int
+}
+
+func (c *fakeConnRequester) Start() { c.started++ }
+func (c *fakeConnRequester) Stop()  { c.stopped++ }
+func (c *fakeConnRequester) WaitUntilUpLoop(timeout, retryAfter time.Duration, maxRetries int) error {
+	if c.down {
+		return errors.New("no connection")
+	}
+	return nil
+}
+
+type apiTest struct {
+	api    *fakeAPI
+	conn   *fakeConnRequester
+	clock  *simClock
+	events []string
+}
+
+// setupAPITest sends heartbeats through the api sink to a fake API.
+func setupAPITest(t *testing.T, password string) *apiTest {
+	restoreGlobals(t)
+	a := &apiTest{
+		api:   newFakeAPI(t),
+		conn:  &fakeConnRequester{},
+		clock: &simClock{now: at(18, 0)},
+	}
+	clock = a.clock
+	statePath = ""
+	state = &persistedState{}
+	heartbeatSinks = []heartbeatSink{apiSink{}}
+	newAPIClient = func() (heartbeatAPI, error) {
+		return newFakeAPIClient(a.api.URL, password)
+	}
+	newConnRequester = func() connRequester { return a.conn }
+	addEvent = func(e eventclient.Event) error {
+		a.events = append(a.events, e.Type)
+		return nil
+	}
+	uploadEvents = func() error { return nil }
+	return a
+}
+
+func TestAPIHeartbeat(t *testing.T) {
+	a := setupAPITest(t, fakeAPIPassword)
+
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), at(22, 0), 3))
+	assert.Equal(t, []time.Time{at(22, 0)}, a.api.received())
+	assert.Equal(t, []string{"device-health"}, a.events)
+	assert.Equal(t, 1, a.conn.started)
+	assert.Equal(t, 1, a.conn.stopped)
+}
+
+func TestAPIHeartbeatRetries(t *testing.T) {
+	a := setupAPITest(t, fakeAPIPassword)
+	heartbeatConf.AttemptDelay = 5 * time.Second
+
+	a.api.failHeartbeats = 2
+	require.NoError(t, sendHeartbeat(context.Background(), at(22, 0), 3, heartbeatSinks))
+	assert.Equal(t, []time.Time{at(22, 0)}, a.api.received())
+	assert.Equal(t, 3, a.api.requests)
+	assert.Equal(t, at(18, 0).Add(10*time.Second), a.clock.Now())
+
+	// Tries attempts times in all.
+	a.api.failHeartbeats = 10
+	a.api.requests = 0
+	assert.Error(t, sendHeartbeat(context.Background(), at(23, 0), 3, heartbeatSinks))
+	assert.Equal(t, 3, a.api.requests)
+	assert.Len(t, a.api.received(), 1)
+}
+
+func TestAPIAuthFailure(t *testing.T) {
+	a := setupAPITest(t, "wrong")
+
+	err := sendOrQueueHeartbeat(context.Background(), at(22, 0), 3)
+	assert.Error(t, err)
+	assert.Equal(t, 3, a.api.authRequests)
+	assert.Equal(t, 0, a.api.requests)
+	assert.Empty(t, a.events)
+	assert.Equal(t, at(22, 0), state.QueuedHeartbeats[apiSinkName])
+}
+
+func TestAPIPartialConnectivity(t *testing.T) {
+	a := setupAPITest(t, fakeAPIPassword)
+
+	// Without a connection the API isn't tried and the heartbeat is queued.
+	a.conn.down = true
+	assert.Error(t, sendOrQueueHeartbeat(context.Background(), at(22, 0), 3))
+	assert.Equal(t, 0, a.api.authRequests)
+	assert.Equal(t, 1, a.conn.stopped)
+	assert.Equal(t, at(22, 0), state.QueuedHeartbeats[apiSinkName])
+
+	// The API is up but failing.
+	a.conn.down = false
+	a.api.failHeartbeats = 10
+	assert.Error(t, sendOrQueueHeartbeat(context.Background(), at(21, 0), 1))
+	assert.Equal(t, at(22, 0), state.QueuedHeartbeats[apiSinkName])
+
+	// Once the API works the queued heartbeat is sent. It is valid for
+	// longer so the new one isn't needed.
+	a.api.failHeartbeats = 0
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), at(21, 0), 1))
+	assert.Equal(t, []time.Time{at(22, 0)}, a.api.received())
+	assert.True(t, state.QueuedHeartbeats[apiSinkName].IsZero())
+
+	// Only a new heartbeat is followed by a device-health event, once.
+	assert.Empty(t, a.events)
+	a.conn.down = true
+	assert.Error(t, sendOrQueueHeartbeat(context.Background(), at(23, 0), 1))
+	a.conn.down = false
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), at(23, 30), 1))
+	assert.Equal(t, []time.Time{at(22, 0), at(23, 0), at(23, 30)}, a.api.received())
+	assert.Equal(t, []string{"device-health"}, a.events)
+}
+
+func TestAPIFinalHeartbeat(t *testing.T) {
+	a := setupAPITest(t, fakeAPIPassword)
+	w := newScheduleAt(t, at(5, 57), PowerWindow{PowerOn: "18:00", PowerOff: "06:00"})
+
+	// Valid until twice the initial delay after the next window starts.
+	require.NoError(t, sendFinalHeartBeat(w))
+	assert.Equal(t, []time.Time{at(19, 0)}, a.api.received())
+
+	// If it can't be sent it is kept to send on the next boot.
+	a.conn.down = true
+	assert.Error(t, sendFinalHeartBeat(w))
+	assert.Equal(t, at(19, 0), state.QueuedHeartbeats[apiSinkName])
+}
@@ -0,0 +1,196 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// sendOrQueueHeartbeat sends a heartbeat to each sink, saving it to be sent
+// later to the sinks it failed for. Any heartbeat queued for a sink is sent
+// first so the sink gets them in order. A sink that still can't be reached
+// isn't tried again, and one that was just sent a heartbeat valid for as long
+// doesn't need this one. Once the heartbeat has been sent to a sink a
+// device-health event is sent with it. An error is only returned if the
+// heartbeat couldn't be sent to any sink.
+func sendOrQueueHeartbeat(ctx context.Context, validUntil time.Time, attempts int) error {
+	sinks := heartbeatSinks
+	covered := map[string]bool{}
+	for _, sink := range sinks {
+		covered[sink.String()] = !queuedHeartbeat(sink).Before(validUntil)
+	}
+	replayErr := replayQueuedHeartbeats(ctx, attempts, sinks)
+	toSend := []heartbeatSink{}
+	for _, sink := range sinks {
+		if !sinkFailed(replayErr, sink) && !covered[sink.String()] {
+			toSend = append(toSend, sink)
+		}
+	}
+	var err error
+	if len(toSend) > 0 {
+		err = heartbeatSender(ctx, validUntil, attempts, toSend)
+	}
+	sent := 0
+	for _, sink := range sinks {
+		if sinkFailed(replayErr, sink) || sinkFailed(err, sink) {
+			queueHeartbeat(sink, validUntil)
+		} else {
+			clearQueuedHeartbeat(sink, validUntil)
+			sent++
+		}
+	}
+	for _, sink := range toSend {
+		if !sinkFailed(err, sink) {
+			sendHealthEvent(validUntil)
+			break
+		}
+	}
+	if err == nil && replayErr != nil {
+		err = replayErr
+	}
+	if err != nil && sent > 0 {
+		log.Printf("heartbeat queued for the sinks it failed to send to: %v", err)
+		return nil
+	}
+	return err
+}
+
+// sinkError is the error from sending a heartbeat to one sink.
+type sinkError struct {
+	sink string
+	err  error
+}
+
+// sinkErrors is returned when a heartbeat fails to send to some sinks.
+type sinkErrors []sinkError
+
+func (e sinkErrors) Error() string {
+	s := ""
+	for i, se := range e {
+		if i > 0 {
+			s += ", "
+		}
+		s += se.sink + ": " + se.err.Error()
+	}
+	return s
+}
+
+// sinkFailed returns true if err means the heartbeat wasn't sent to sink.
+// Errors that aren't for particular sinks count for all of them.
+func sinkFailed(err error, sink heartbeatSink) bool {
+	if err == nil {
+		return false
+	}
+	var errs sinkErrors
+	if !errors.As(err, &errs) {
+		return true
+	}
+	for _, se := range errs {
+		if se.sink == sink.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// queueHeartbeat saves a heartbeat that failed to send to sink. Only the one
+// valid for the longest is kept as that is all the sink needs.
+func queueHeartbeat(sink heartbeatSink, validUntil time.Time) {
+	err := state.update(func(s *persistedState) {
+		if s.QueuedHeartbeats == nil {
+			s.QueuedHeartbeats = map[string]time.Time{}
+		}
+		if validUntil.After(s.QueuedHeartbeats[sink.String()]) {
+			s.QueuedHeartbeats[sink.String()] = validUntil
+		}
+	})
+	if err != nil {
+		log.Printf("failed to queue heartbeat: %v", err)
+	}
+}
+
+// clearQueuedHeartbeat removes the heartbeat queued for sink if it isn't
+// valid for longer than the one sent.
+func clearQueuedHeartbeat(sink heartbeatSink, sent time.Time) {
+	queued := queuedHeartbeat(sink)
+	if queued.IsZero() || queued.After(sent) {
+		return
+	}
+	err := state.update(func(s *persistedState) {
+		if !s.QueuedHeartbeats[sink.String()].After(sent) {
+			delete(s.QueuedHeartbeats, sink.String())
+		}
+	})
+	if err != nil {
+		log.Printf("failed to clear queued heartbeat: %v", err)
+	}
+}
+
+func queuedHeartbeat(sink heartbeatSink) time.Time {
+	var queued time.Time
+	state.get(func(s *persistedState) { queued = s.QueuedHeartbeats[sink.String()] })
+	return queued
+}
+
+// replayQueuedHeartbeats sends the heartbeats queued for the sinks if they
+// are still valid. Sinks with the same heartbeat queued are sent it together.
+// The sinks it still failed to send to are returned as sinkErrors.
+func replayQueuedHeartbeats(ctx context.Context, attempts int, sinks []heartbeatSink) error {
+	bySent := map[time.Time][]heartbeatSink{}
+	for _, sink := range sinks {
+		queued := queuedHeartbeat(sink)
+		if queued.IsZero() {
+			continue
+		}
+		if !queued.After(clock.Now()) {
+			log.Printf("dropping heartbeat queued for %s as it was only valid until %v", sink, queued)
+			clearQueuedHeartbeat(sink, queued)
+			continue
+		}
+		bySent[queued] = append(bySent[queued], sink)
+	}
+	times := make([]time.Time, 0, len(bySent))
+	for t := range bySent {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	var failed sinkErrors
+	for _, queued := range times {
+		log.Printf("sending queued heartbeat, valid until %v", queued)
+		err := heartbeatSender(ctx, queued, attempts, bySent[queued])
+		if err != nil {
+			log.Printf("failed to send queued heartbeat: %v", err)
+		}
+		for _, sink := range bySent[queued] {
+			if sinkFailed(err, sink) {
+				failed = append(failed, sinkError{sink: sink.String(), err: err})
+			} else {
+				clearQueuedHeartbeat(sink, queued)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// heartbeatRunner runs the heartbeat loop for the power machine. It is an
+// interface so the simulator can run heartbeats on its virtual clock.
+type heartbeatRunner interface {
+	// Start starts sending heartbeats for the window if they aren't already
+	// being sent.
+	Start(w *Schedule)
+	// Stop stops sending heartbeats, waiting for the loop to finish. A
+	// heartbeat being retried is given up on and queued.
+	Stop()
+	// Reschedule restarts the heartbeats, such as when the window has
+	// changed.
+	Reschedule(w *Schedule)
+	Status() heartbeatStatus
+}
+
+// heartbeats is used by the power machine to send heartbeats.
+var heartbeats heartbeatRunner = newHeartbeatScheduler()
+
+type heartbeatStatus struct {
+	Running        bool      `json:"running"`
+	LastValidUntil time.Time `json:"lastValidUntil,omitempty"`
+	LastError      string    `json:"lastError,omitempty"`
+	NextBeat       time.Time `json:"nextBeat,omitempty"`
+}
+
+// heartbeatScheduler runs at most one heartbeat loop at a time.
+type heartbeatScheduler struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	status heartbeatStatus
+}
+
+func newHeartbeatScheduler() *heartbeatScheduler {
+	return &heartbeatScheduler{}
+}
+
+func (s *heartbeatScheduler) Start(w *Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Running {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.cancel = cancel
+	s.done = done
+	s.status.Running = true
+	s.status.NextBeat = time.Time{}
+	go func() {
+		defer close(done)
+		heartBeatLoop(ctx, w, s)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.done == done {
+			s.status.Running = false
+			s.status.NextBeat = time.Time{}
+		}
+	}()
+}
+
+func (s *heartbeatScheduler) Stop() {
+	s.mu.Lock()
+	cancel := s.cancel
+	done := s.done
+	s.cancel = nil
+	s.done = nil
+	s.status.Running = false
+	s.status.NextBeat = time.Time{}
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (s *heartbeatScheduler) Reschedule(w *Schedule) {
+	s.Stop()
+	s.Start(w)
+}
+
+func (s *heartbeatScheduler) Status() heartbeatStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *heartbeatScheduler) beatSent(validUntil time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LastValidUntil = validUntil
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+}
+
+func (s *heartbeatScheduler) nextBeatAt(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.NextBeat = t
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingClock never fires so heartbeat loops wait until stopped.
+type blockingClock struct {
+	now time.Time
+}
+
+func (c *blockingClock) Sleep(d time.Duration)                  {}
+func (c *blockingClock) Now() time.Time                         { return c.now }
+func (c *blockingClock) After(d time.Duration) <-chan time.Time { return make(chan time.Time) }
+
+// firstAfterClock fires the first After straight away, then never again.
+type firstAfterClock struct {
+	blockingClock
+	fired bool
+}
+
+func (c *firstAfterClock) After(d time.Duration) <-chan time.Time {
+	if c.fired {
+		return c.blockingClock.After(d)
+	}
+	c.fired = true
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func setupScheduler(t *testing.T, c Clock) *Schedule {
+	restoreGlobals(t)
+	statePath = ""
+	clock = c
+	getModemConnectedSignal = func() (chan time.Time, error) {
+		return make(chan time.Time), nil
+	}
+	heartbeatSender = func(context.Context, time.Time, int, []heartbeatSink) error { return nil }
+	w := newScheduleAt(t, at(18, 0), PowerWindow{PowerOn: "18:00", PowerOff: "06:00"})
+	w.Now = c.Now
+	return w
+}
+
+func TestHeartbeatSchedulerStartStop(t *testing.T) {
+	w := setupScheduler(t, &blockingClock{now: at(18, 0)})
+	s := newHeartbeatScheduler()
+
+	s.Start(w)
+	require.Eventually(t, func() bool { return !s.Status().NextBeat.IsZero() }, time.Second, time.Millisecond)
+	assert.True(t, s.Status().Running)
+	assert.Equal(t, at(18, 30), s.Status().NextBeat)
+
+	// Starting again doesn't start a second loop.
+	first := s.done
+	s.Start(w)
+	assert.Equal(t, first, s.done)
+
+	s.Stop()
+	assert.False(t, s.Status().Running)
+	select {
+	case <-first:
+	default:
+		t.Fatal("loop still running after stop")
+	}
+
+	// Stopping when not running is fine.
+	s.Stop()
+}
+
+func TestHeartbeatSchedulerReschedule(t *testing.T) {
+	w := setupScheduler(t, &blockingClock{now: at(18, 0)})
+	s := newHeartbeatScheduler()
+
+	s.Start(w)
+	first := s.done
+	s.Reschedule(w)
+	assert.NotEqual(t, first, s.done)
+	assert.True(t, s.Status().Running)
+	select {
+	case <-first:
+	default:
+		t.Fatal("first loop still running after reschedule")
+	}
+	s.Stop()
+}
+
+func TestHeartbeatSchedulerFinishes(t *testing.T) {
+	w := setupScheduler(t, &simClock{now: at(18, 0)})
+	s := newHeartbeatScheduler()
+
+	s.Start(w)
+	<-s.done
+	status := s.Status()
+	assert.False(t, status.Running)
+	assert.Equal(t, at(30, 0), status.LastValidUntil)
+	assert.Empty(t, status.LastError)
+}
+
+func TestHeartbeatSchedulerStopWhileSending(t *testing.T) {
+	w := setupScheduler(t, &firstAfterClock{blockingClock: blockingClock{now: at(18, 0)}})
+	state = &persistedState{}
+	heartbeatSender = sendHeartbeat
+	heartbeatSinks = []heartbeatSink{apiSink{}}
+	heartbeatConf.MaxAttempts = 3
+	newConnRequester = func() connRequester { return &fakeConnRequester{} }
+	var mu sync.Mutex
+	connects := 0
+	newAPIClient = func() (heartbeatAPI, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		connects++
+		return nil, errors.New("no api")
+	}
+	s := newHeartbeatScheduler()
+
+	// The api sink is waiting to try again, which the clock never lets
+	// happen, so Stop has to cancel it.
+	s.Start(w)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return connects == 1
+	}, time.Second, time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop waited for the heartbeat to finish retrying")
+	}
+	assert.Equal(t, 1, connects)
+	assert.Equal(t, at(18, 0).Add(heartbeatConf.Interval), state.QueuedHeartbeats[apiSinkName])
+}
@@ -0,0 +1,343 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/TheCacophonyProject/go-api"
+	"github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/modemd/connrequester"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	apiSinkName    = "api"
+	mqttSinkName   = "mqtt"
+	fileSinkName   = "file"
+	socketSinkName = "socket"
+
+	// How long to wait writing to the heartbeat socket.
+	socketSinkTimeout = 5 * time.Second
+)
+
+// heartbeatSink is somewhere heartbeats are sent.
+type heartbeatSink interface {
+	// send sends a heartbeat valid until validUntil, trying up to attempts
+	// times in all. It gives up waiting to try again once ctx is cancelled.
+	send(ctx context.Context, validUntil time.Time, attempts int) error
+	// online returns true if an internet connection is needed to send.
+	online() bool
+	String() string
+}
+
+// heartbeatSinks are set from the config on startup.
+var heartbeatSinks = []heartbeatSink{apiSink{}}
+
+// heartbeatAPI is the part of the Cacophony API client used to send
+// heartbeats.
+type heartbeatAPI interface {
+	Heartbeat(nextHeartBeat time.Time) ([]byte, error)
+}
+
+// connRequester keeps the modem up while heartbeats are sent.
+type connRequester interface {
+	Start()
+	Stop()
+	WaitUntilUpLoop(timeout, retryAfter time.Duration, maxRetries int) error
+}
+
+// These are variables so tests can replace them.
+var (
+	newMQTTClient = mqtt.NewClient
+	newAPIClient  = func() (heartbeatAPI, error) {
+		return api.New()
+	}
+	newConnRequester = func() connRequester {
+		return connrequester.NewConnectionRequester()
+	}
+)
+
+// newHeartbeatSinks makes the heartbeat sinks listed in the config.
+func newHeartbeatSinks(conf HeartbeatConfig, device config.Device) ([]heartbeatSink, error) {
+	sinks := []heartbeatSink{}
+	for _, name := range conf.Sinks {
+		switch name {
+		case apiSinkName:
+			sinks = append(sinks, apiSink{})
+		case mqttSinkName:
+			sinks = append(sinks, newMQTTSink(conf.MQTT, device))
+		case fileSinkName:
+			sinks = append(sinks, &fileSink{path: conf.File, device: device})
+		case socketSinkName:
+			sinks = append(sinks, &socketSink{path: conf.Socket, device: device})
+		default:
+			return nil, fmt.Errorf("unknown heartbeat sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
+// sendHeartbeat sends a heartbeat to each of the sinks, bringing up the modem
+// first if any of them need it. Sinks aren't sent to once ctx is cancelled.
+// If any sink fails sinkErrors is returned.
+func sendHeartbeat(ctx context.Context, validUntil time.Time, attempts int, sinks []heartbeatSink) error {
+	var connErr error
+	if needsConnection(sinks) {
+		cr := newConnRequester()
+		cr.Start()
+		defer cr.Stop()
+		connErr = cr.WaitUntilUpLoop(heartbeatConf.ConnTimeout, heartbeatConf.ConnRetryInterval, heartbeatConf.ConnMaxRetries)
+		if connErr != nil {
+			log.Println("unable to get an internet connection. Not reporting events")
+		}
+	}
+	failed := sinkErrors{}
+	for _, sink := range sinks {
+		err := connErr
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if err == nil || !sink.online() {
+			err = sink.send(ctx, validUntil, attempts)
+		}
+		if err != nil {
+			failed = append(failed, sinkError{sink: sink.String(), err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// attemptDelay waits before trying to send a heartbeat again. It returns
+// ctx's error if it is cancelled first.
+func attemptDelay(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clock.After(heartbeatConf.AttemptDelay):
+		return nil
+	}
+}
+
+func needsConnection(sinks []heartbeatSink) bool {
+	for _, sink := range sinks {
+		if sink.online() {
+			return true
+		}
+	}
+	return false
+}
+
+// heartbeatMessage is what is sent to the mqtt, file and socket sinks.
+type heartbeatMessage struct {
+	Device     string    `json:"device,omitempty"`
+	DeviceID   int       `json:"deviceID,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	Sent       time.Time `json:"sent"`
+	ValidUntil time.Time `json:"validUntil"`
+}
+
+func newHeartbeatMessage(device config.Device, validUntil time.Time) ([]byte, error) {
+	return json.Marshal(heartbeatMessage{
+		Device:     device.Name,
+		DeviceID:   device.ID,
+		Group:      device.Group,
+		Sent:       clock.Now(),
+		ValidUntil: validUntil,
+	})
+}
+
+// apiSink sends heartbeats to the Cacophony API.
+type apiSink struct{}
+
+func (apiSink) online() bool   { return true }
+func (apiSink) String() string { return apiSinkName }
+
+func (apiSink) send(ctx context.Context, validUntil time.Time, attempts int) error {
+	var apiClient heartbeatAPI
+	var err error
+	attempt := 0
+	for {
+		apiClient, err = newAPIClient()
+		if err != nil {
+			attempt += 1
+			if attempt < attempts {
+				log.Printf("Error connecting to api %v trying again in %v", err, heartbeatConf.AttemptDelay)
+				if err := attemptDelay(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Printf("Error connecting to api %v", err)
+			return err
+		}
+		break
+	}
+
+	attempt = 0
+	for {
+		_, err = apiClient.Heartbeat(validUntil)
+		if err == nil {
+			log.Printf("Sent heartbeat, valid until %v", validUntil)
+			return nil
+		}
+		attempt += 1
+		if attempt >= attempts {
+			break
+		}
+		log.Printf("Error sending heartbeat %v, trying again in %v", err, heartbeatConf.AttemptDelay)
+		if err := attemptDelay(ctx); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// mqttSink publishes heartbeats to an MQTT broker. It connects for each
+// heartbeat as they are hours apart.
+type mqttSink struct {
+	conf   HeartbeatMQTT
+	device config.Device
+}
+
+func newMQTTSink(conf HeartbeatMQTT, device config.Device) *mqttSink {
+	if conf.Topic == "" {
+		conf.Topic = "cacophony/heartbeat"
+		if device.Name != "" {
+			conf.Topic = "cacophony/" + device.Name + "/heartbeat"
+		}
+	}
+	if conf.ClientID == "" {
+		conf.ClientID = "attiny-controller"
+		if device.Name != "" {
+			conf.ClientID += "-" + device.Name
+		}
+	}
+	return &mqttSink{conf: conf, device: device}
+}
+
+func (s *mqttSink) online() bool   { return true }
+func (s *mqttSink) String() string { return mqttSinkName }
+
+func (s *mqttSink) send(ctx context.Context, validUntil time.Time, attempts int) error {
+	payload, err := newHeartbeatMessage(s.device, validUntil)
+	if err != nil {
+		return err
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(s.conf.Broker).
+		SetClientID(s.conf.ClientID).
+		SetUsername(s.conf.Username).
+		SetPassword(s.conf.Password).
+		SetConnectTimeout(s.conf.Timeout).
+		SetAutoReconnect(false)
+	client := newMQTTClient(opts)
+	if err := s.wait(client.Connect()); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", s.conf.Broker, err)
+	}
+	defer client.Disconnect(250)
+
+	attempt := 0
+	for {
+		err = s.wait(client.Publish(s.conf.Topic, s.conf.QoS, s.conf.Retain, payload))
+		if err == nil {
+			log.Printf("Published heartbeat to %s, valid until %v", s.conf.Topic, validUntil)
+			return nil
+		}
+		attempt += 1
+		if attempt >= attempts {
+			return err
+		}
+		log.Printf("Error publishing heartbeat %v, trying again in %v", err, heartbeatConf.AttemptDelay)
+		if err := attemptDelay(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *mqttSink) wait(t mqtt.Token) error {
+	if !t.WaitTimeout(s.conf.Timeout) {
+		return fmt.Errorf("timed out after %s", s.conf.Timeout)
+	}
+	return t.Error()
+}
+
+// fileSink appends heartbeats to a file, one JSON object per line.
+type fileSink struct {
+	path   string
+	device config.Device
+}
+
+func (s *fileSink) online() bool   { return false }
+func (s *fileSink) String() string { return fileSinkName }
+
+func (s *fileSink) send(ctx context.Context, validUntil time.Time, attempts int) error {
+	b, err := newHeartbeatMessage(s.device, validUntil)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// socketSink writes heartbeats to a unix socket, one JSON object per line.
+// A connection is made for each heartbeat.
+type socketSink struct {
+	path   string
+	device config.Device
+}
+
+func (s *socketSink) online() bool   { return false }
+func (s *socketSink) String() string { return socketSinkName }
+
+func (s *socketSink) send(ctx context.Context, validUntil time.Time, attempts int) error {
+	b, err := newHeartbeatMessage(s.device, validUntil)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("unix", s.path, socketSinkTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(socketSinkTimeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/go-config"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testDevice = config.Device{Name: "test-device", ID: 42, Group: "test-group"}
+
+func useSinkClock(t *testing.T) time.Time {
+	restoreGlobals(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock = &simClock{now: now}
+	return now
+}
+
+func readMessages(t *testing.T, path string) []heartbeatMessage {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	msgs := []heartbeatMessage{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var m heartbeatMessage
+		require.NoError(t, json.Unmarshal([]byte(line), &m))
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func TestFileSink(t *testing.T) {
+	now := useSinkClock(t)
+	path := filepath.Join(t.TempDir(), "heartbeats", "heartbeats.jsonl")
+	sink := &fileSink{path: path, device: testDevice}
+
+	require.NoError(t, sink.send(context.Background(), now.Add(4*time.Hour), 1))
+	require.NoError(t, sink.send(context.Background(), now.Add(8*time.Hour), 1))
+
+	msgs := readMessages(t, path)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "test-device", msgs[0].Device)
+	assert.Equal(t, 42, msgs[0].DeviceID)
+	assert.Equal(t, "test-group", msgs[0].Group)
+	assert.True(t, now.Equal(msgs[0].Sent))
+	assert.True(t, now.Add(4*time.Hour).Equal(msgs[0].ValidUntil))
+	assert.True(t, now.Add(8*time.Hour).Equal(msgs[1].ValidUntil))
+}
+
+func TestSocketSink(t *testing.T) {
+	now := useSinkClock(t)
+	path := filepath.Join(t.TempDir(), "heartbeat.sock")
+	sink := &socketSink{path: path, device: testDevice}
+
+	// Nothing listening.
+	assert.Error(t, sink.send(context.Background(), now.Add(4*time.Hour), 1))
+
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+
+	require.NoError(t, sink.send(context.Background(), now.Add(4*time.Hour), 1))
+	var m heartbeatMessage
+	require.NoError(t, json.Unmarshal([]byte(<-lines), &m))
+	assert.Equal(t, "test-device", m.Device)
+	assert.True(t, now.Add(4*time.Hour).Equal(m.ValidUntil))
+}
+
+type fakeToken struct {
+	err error
+}
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (t fakeToken) Error() error { return t.err }
+
+type published struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+// fakeMQTTClient records what is published. Methods the sink doesn't use
+// aren't implemented.
+type fakeMQTTClient struct {
+	mqtt.Client
+	opts         *mqtt.ClientOptions
+	connectErr   error
+	publishErrs  []error
+	published    []published
+	disconnected bool
+}
+
+func (c *fakeMQTTClient) Connect() mqtt.Token { return fakeToken{c.connectErr} }
+func (c *fakeMQTTClient) Disconnect(uint)     { c.disconnected = true }
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retain bool, payload interface{}) mqtt.Token {
+	if len(c.publishErrs) > 0 {
+		err := c.publishErrs[0]
+		c.publishErrs = c.publishErrs[1:]
+		return fakeToken{err}
+	}
+	c.published = append(c.published, published{topic, qos, retain, payload.([]byte)})
+	return fakeToken{}
+}
+
+func useFakeMQTT(t *testing.T, client *fakeMQTTClient) {
+	restoreGlobals(t)
+	newMQTTClient = func(o *mqtt.ClientOptions) mqtt.Client {
+		client.opts = o
+		return client
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+	now := useSinkClock(t)
+	client := &fakeMQTTClient{publishErrs: []error{errors.New("not yet")}}
+	useFakeMQTT(t, client)
+	conf := DefaultHeartbeatConfig().MQTT
+	conf.Broker = "tcp://broker.example.org:1883"
+	conf.Username = "user"
+	sink := newMQTTSink(conf, testDevice)
+
+	require.NoError(t, sink.send(context.Background(), now.Add(4*time.Hour), 2))
+	assert.Equal(t, "tcp://broker.example.org:1883", client.opts.Servers[0].String())
+	assert.Equal(t, "attiny-controller-test-device", client.opts.ClientID)
+	assert.Equal(t, "user", client.opts.Username)
+	assert.True(t, client.disconnected)
+	require.Len(t, client.published, 1)
+	p := client.published[0]
+	assert.Equal(t, "cacophony/test-device/heartbeat", p.topic)
+	assert.Equal(t, byte(1), p.qos)
+	assert.True(t, p.retain)
+	var m heartbeatMessage
+	require.NoError(t, json.Unmarshal(p.payload, &m))
+	assert.Equal(t, 42, m.DeviceID)
+	assert.True(t, now.Add(4*time.Hour).Equal(m.ValidUntil))
+
+	// Out of attempts.
+	client.publishErrs = []error{errors.New("nope"), errors.New("nope")}
+	assert.Error(t, sink.send(context.Background(), now.Add(4*time.Hour), 2))
+
+	client.connectErr = errors.New("refused")
+	assert.Error(t, sink.send(context.Background(), now.Add(4*time.Hour), 2))
+}
+
+// failingSink always fails to send.
+type failingSink struct {
+	sent int
+}
+
+func (s *failingSink) online() bool   { return false }
+func (s *failingSink) String() string { return "failing" }
+func (s *failingSink) send(context.Context, time.Time, int) error {
+	s.sent++
+	return errors.New("broken")
+}
+
+func TestSendHeartbeatToSinks(t *testing.T) {
+	now := useSinkClock(t)
+	path := filepath.Join(t.TempDir(), "heartbeats.jsonl")
+	failing := &failingSink{}
+	conf := DefaultHeartbeatConfig()
+	conf.Sinks = []string{fileSinkName}
+	conf.File = path
+	sinks, err := newHeartbeatSinks(conf, testDevice)
+	require.NoError(t, err)
+	heartbeatSinks = append(sinks, failing)
+
+	// The other sinks still get the heartbeat if one fails.
+	err = sendHeartbeat(context.Background(), now.Add(4*time.Hour), 1, heartbeatSinks)
+	assert.EqualError(t, err, "failing: broken")
+	assert.Equal(t, 1, failing.sent)
+	assert.Len(t, readMessages(t, path), 1)
+
+	heartbeatSinks = sinks
+	assert.NoError(t, sendHeartbeat(context.Background(), now.Add(8*time.Hour), 1, heartbeatSinks))
+	assert.Len(t, readMessages(t, path), 2)
+}
+
+// flakySink records the heartbeats sent to it, failing while fail is set.
+type flakySink struct {
+	fail bool
+	sent []time.Time
+}
+
+func (s *flakySink) online() bool   { return false }
+func (s *flakySink) String() string { return "flaky" }
+func (s *flakySink) send(ctx context.Context, validUntil time.Time, attempts int) error {
+	if s.fail {
+		return errors.New("broken")
+	}
+	s.sent = append(s.sent, validUntil)
+	return nil
+}
+
+func TestHeartbeatQueuedPerSink(t *testing.T) {
+	now := useSinkClock(t)
+	statePath = ""
+	state = &persistedState{}
+	path := filepath.Join(t.TempDir(), "heartbeats.jsonl")
+	flaky := &flakySink{fail: true}
+	file := &fileSink{path: path, device: testDevice}
+	heartbeatSinks = []heartbeatSink{file, flaky}
+
+	// A dead sink doesn't fail the heartbeat, it is queued just for that sink.
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), now.Add(4*time.Hour), 1))
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), now.Add(8*time.Hour), 1))
+	assert.Equal(t, map[string]time.Time{"flaky": now.Add(8 * time.Hour)}, state.QueuedHeartbeats)
+	assert.Len(t, readMessages(t, path), 2)
+
+	// Once it works again only that sink is sent the queued heartbeat,
+	// instead of the shorter new one.
+	flaky.fail = false
+	require.NoError(t, sendOrQueueHeartbeat(context.Background(), now.Add(6*time.Hour), 1))
+	assert.Equal(t, []time.Time{now.Add(8 * time.Hour)}, flaky.sent)
+	assert.Len(t, readMessages(t, path), 3)
+	assert.Empty(t, state.QueuedHeartbeats)
+
+	// The heartbeat only fails if no sink got it.
+	flaky.fail = true
+	file.path = t.TempDir()
+	assert.Error(t, sendOrQueueHeartbeat(context.Background(), now.Add(10*time.Hour), 1))
+	assert.Equal(t, now.Add(10*time.Hour), state.QueuedHeartbeats["flaky"])
+	assert.Equal(t, now.Add(10*time.Hour), state.QueuedHeartbeats[fileSinkName])
+}
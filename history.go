@@ -0,0 +1,229 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	historyFile = "/var/lib/attiny-controller/history.jsonl"
+
+	// The oldest power cycles are dropped from the history once it has
+	// more than this many.
+	maxHistoryCycles = 1000
+)
+
+// historyPath is where finished power cycles are appended. If empty no
+// history is kept.
+var historyPath = historyFile
+
+// cycleRecord is one boot of the device through to it powering off. The
+// current cycle is kept in the state and appended to the history on the next
+// boot.
+type cycleRecord struct {
+	Boot       time.Time `json:"boot"`
+	WakeReason string    `json:"wakeReason"`
+	// SleepStart and ExpectedWake are when the previous power off was
+	// requested and when it should have woken the device, and SleepMinutes
+	// is what the ATtiny was asked to sleep for. ActualWake,
+	// WakeDriftSeconds and WokeOnTime are set once the clock is trusted.
+	SleepStart       time.Time `json:"sleepStart,omitempty"`
+	SleepMinutes     int       `json:"sleepMinutes,omitempty"`
+	ExpectedWake     time.Time `json:"expectedWake,omitempty"`
+	ActualWake       time.Time `json:"actualWake,omitempty"`
+	WakeDriftSeconds int64     `json:"wakeDriftSeconds,omitempty"`
+	WokeOnTime       *bool     `json:"wokeOnTime,omitempty"`
+
+	// PlannedPowerOff is when the on window ended.
+	PlannedPowerOff time.Time `json:"plannedPowerOff,omitempty"`
+	PowerOff        time.Time `json:"powerOff,omitempty"`
+	PowerOffMinutes int       `json:"powerOffMinutes,omitempty"`
+	WakeAt          time.Time `json:"wakeAt,omitempty"`
+	Shutdown        *bool     `json:"shutdown,omitempty"`
+	ShutdownError   string    `json:"shutdownError,omitempty"`
+}
+
+// startCycle appends the previous power cycle to the history and starts a
+// new one for this boot.
+func startCycle(reason wakeReason) {
+	now := clock.Now()
+	cycle := &cycleRecord{
+		Boot:       now,
+		WakeReason: reason.String(),
+	}
+	var prev *cycleRecord
+	state.get(func(s *persistedState) { prev = s.Cycle })
+	if prev != nil {
+		if err := appendHistory(prev); err != nil {
+			log.Printf("failed to save power cycle history: %v", err)
+		}
+		cycle.SleepStart = prev.PowerOff
+		cycle.SleepMinutes = prev.PowerOffMinutes
+		cycle.ExpectedWake = prev.WakeAt
+	}
+	err := state.update(func(s *persistedState) { s.Cycle = cycle })
+	if err != nil {
+		log.Printf("failed to save power cycle: %v", err)
+	}
+}
+
+// updateCycle changes the current power cycle with f and saves it.
+func updateCycle(f func(c *cycleRecord)) {
+	err := state.update(func(s *persistedState) {
+		if s.Cycle != nil {
+			f(s.Cycle)
+		}
+	})
+	if err != nil {
+		log.Printf("failed to save power cycle: %v", err)
+	}
+}
+
+func appendHistory(c *cycleRecord) error {
+	if historyPath == "" {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(historyPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return trimHistory()
+}
+
+// trimHistory drops the oldest power cycles once there are more than
+// maxHistoryCycles.
+func trimHistory() error {
+	b, err := os.ReadFile(historyPath)
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= maxHistoryCycles {
+		return nil
+	}
+	tmp := historyPath + ".tmp"
+	if err := os.WriteFile(tmp, bytes.Join(lines[len(lines)-maxHistoryCycles:], nil), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, historyPath)
+}
+
+// powerHistory returns the last n power cycles, up to maxCycles, ending with
+// the current one.
+func powerHistory(n int) ([]cycleRecord, error) {
+	n, err := cycleCount(n)
+	if err != nil {
+		return nil, err
+	}
+	cycles, err := readHistory()
+	if err != nil {
+		return nil, err
+	}
+	state.get(func(s *persistedState) {
+		if s.Cycle != nil {
+			cycles = append(cycles, *s.Cycle)
+		}
+	})
+	if len(cycles) > n {
+		cycles = cycles[len(cycles)-n:]
+	}
+	return cycles, nil
+}
+
+func readHistory() ([]cycleRecord, error) {
+	cycles := []cycleRecord{}
+	if historyPath == "" {
+		return cycles, nil
+	}
+	f, err := os.Open(historyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return cycles, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var c cycleRecord
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			// A line can be cut short if power was lost while writing it.
+			log.Printf("skipping bad power cycle history line: %v", err)
+			continue
+		}
+		cycles = append(cycles, c)
+	}
+	return cycles, scanner.Err()
+}
+
+func printHistory(out io.Writer, cycles []cycleRecord) {
+	for _, c := range cycles {
+		line := fmt.Sprintf("boot %s (%s", c.Boot.Local().Format(simTimeFormat), c.WakeReason)
+		if c.WokeOnTime != nil {
+			if *c.WokeOnTime {
+				line += ", on time"
+			} else {
+				line += fmt.Sprintf(", %s from expected %s", time.Duration(c.WakeDriftSeconds)*time.Second,
+					c.ExpectedWake.Local().Format(simTimeFormat))
+			}
+		}
+		line += ")"
+		if !c.PowerOff.IsZero() {
+			line += fmt.Sprintf(", off %s for %d minutes", c.PowerOff.Local().Format(simTimeFormat), c.PowerOffMinutes)
+			if !c.PlannedPowerOff.IsZero() {
+				line += fmt.Sprintf(" (planned %s)", c.PlannedPowerOff.Local().Format(simTimeFormat))
+			}
+		}
+		if c.Shutdown != nil {
+			if *c.Shutdown {
+				line += ", shutdown ok"
+			} else {
+				line += ", shutdown failed: " + strings.TrimSpace(c.ShutdownError)
+			}
+		}
+		fmt.Fprintln(out, line)
+	}
+}
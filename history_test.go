@@ -0,0 +1,89 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPowerHistory(t *testing.T) {
+	restoreGlobals(t)
+	dir := t.TempDir()
+	historyPath = filepath.Join(dir, "history.jsonl")
+	statePath = filepath.Join(dir, "state.json")
+	state = &persistedState{}
+
+	startCycle(wakePowerRestored)
+	updateCycle(func(c *cycleRecord) {
+		c.PowerOffMinutes = 60
+		c.WakeAt = time.Now()
+	})
+	startCycle(wakeScheduled)
+	updateCycle(func(c *cycleRecord) {
+		c.PowerOffMinutes = 30
+		c.WakeAt = time.Now().Add(time.Hour)
+	})
+	startCycle(wakeWatchdog)
+
+	cycles, err := powerHistory(10)
+	require.NoError(t, err)
+	require.Len(t, cycles, 3)
+	assert.Equal(t, "power-restored", cycles[0].WakeReason)
+	assert.True(t, cycles[0].ExpectedWake.IsZero())
+	assert.Equal(t, 60, cycles[0].PowerOffMinutes)
+
+	assert.Equal(t, "scheduled", cycles[1].WakeReason)
+	assert.Equal(t, cycles[0].WakeAt.Unix(), cycles[1].ExpectedWake.Unix())
+
+	assert.Equal(t, "watchdog", cycles[2].WakeReason)
+	assert.Equal(t, cycles[1].WakeAt.Unix(), cycles[2].ExpectedWake.Unix())
+
+	// The current cycle is kept after loading the state again.
+	state = &persistedState{}
+	require.NoError(t, loadState())
+	cycles, err = powerHistory(2)
+	require.NoError(t, err)
+	require.Len(t, cycles, 2)
+	assert.Equal(t, "scheduled", cycles[0].WakeReason)
+	assert.Equal(t, "watchdog", cycles[1].WakeReason)
+}
+
+func TestPowerHistoryLimits(t *testing.T) {
+	restoreGlobals(t)
+	historyPath = filepath.Join(t.TempDir(), "history.jsonl")
+	statePath = ""
+	state = &persistedState{}
+
+	lines := []string{}
+	for i := 0; i < maxHistoryCycles; i++ {
+		lines = append(lines, fmt.Sprintf(`{"powerOffMinutes":%d}`, i))
+	}
+	require.NoError(t, os.WriteFile(historyPath, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	// The oldest cycle is dropped once there are too many.
+	require.NoError(t, appendHistory(&cycleRecord{PowerOffMinutes: maxHistoryCycles}))
+	cycles, err := readHistory()
+	require.NoError(t, err)
+	require.Len(t, cycles, maxHistoryCycles)
+	assert.Equal(t, 1, cycles[0].PowerOffMinutes)
+	assert.Equal(t, maxHistoryCycles, cycles[len(cycles)-1].PowerOffMinutes)
+
+	cycles, err = powerHistory(maxCycles + 1)
+	require.NoError(t, err)
+	assert.Len(t, cycles, maxCycles)
+
+	_, err = powerHistory(0)
+	assert.Error(t, err)
+	_, err = powerHistory(-1)
+	assert.Error(t, err)
+}
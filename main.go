@@ -19,98 +19,53 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"runtime"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	"github.com/TheCacophonyProject/go-config"
 	arg "github.com/alexflint/go-arg"
 	linuxproc "github.com/c9s/goprocinfo/linux"
-	"golang.org/x/sys/unix"
 )
 
-// How long to wait before checking the recording window. This
-// gives time to do something with the device before it turns off.
 const (
-	initialGracePeriod      = 20 * time.Minute
-	batteryCSVFile          = "/var/log/battery.csv"
-	batteryReadingInterval  = 10 * time.Minute
-	systemStatFile          = "/proc/stat"
-	saltCommandWaitDuration = 30 * time.Minute
+	// How long to wait before trying again if the ATtiny didn't accept a
+	// power off.
+	powerOffRetryInterval = 5 * time.Minute
+
+	batteryCSVFile         = "/var/log/battery.csv"
+	batteryReadingInterval = 10 * time.Minute
+	systemStatFile         = "/proc/stat"
 )
 
 var (
 	version = "<not set>"
 
-	mu                 sync.Mutex
-	stayOnUntil        = time.Now()
-	saltCommandWaitEnd = time.Time{}
+	// These are variables so the simulator can replace them.
+	addEvent     = eventclient.AddEvent
+	uploadEvents = eventclient.UploadEvents
 )
 
-func shouldTurnOff(minutesUntilActive int) bool {
-	mu.Lock()
-	defer mu.Unlock()
-	turnOff := true
-	if time.Now().Before(stayOnUntil) {
-		turnOff = false
-	} else if minutesUntilActive < 15 {
-		turnOff = false
-	}
-	if !turnOff {
-		saltCommandWaitEnd = time.Time{} // Not waiting for salt command
-		return false
-	}
-	return !shouldStayOnForSalt()
+// powerOffer is what the power machine needs from the ATtiny.
+type powerOffer interface {
+	PowerOff(minutes int) error
+	CancelPowerOff() error
 }
 
-// shouldStayOnForSalt will check if a salt command is running via checking the output from `salt-call saltutil.running`
-// If a device is being kept on for too long because of salt commands it will ignore the salt command check.
-func shouldStayOnForSalt() bool {
-	if saltCommandWaitEnd.IsZero() {
-		saltCommandWaitEnd = time.Now().Add(saltCommandWaitDuration)
+// powerOffMinutes is how long the ATtiny is asked to power off for so the
+// device is back on the wake lead before the window starts. If that is longer than the
+// ATtiny can sleep for in one go then chained is true and the device will wake
+// early and need to power off again.
+func powerOffMinutes(minutesUntilActive int, power Power) (minutes int, chained bool) {
+	minutes = minutesUntilActive - int(power.WakeLead.Minutes())
+	if minutes > maxSleepMinutes {
+		return maxSleepMinutes, true
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
-
-	stdout, err := exec.CommandContext(ctx, "salt-call", "--local", "saltutil.running").Output()
-	if err != nil {
-		log.Println(err)
-		return false
-	}
-
-	strOut := string(stdout)
-	if strings.Count(strOut, "\n") <= 2 { // If a salt command is running the output will have much more than 2 lines.
-		return false
-	}
-
-	if time.Now().After(saltCommandWaitEnd) {
-		log.Printf("waiting for salt command for too long (%v)", saltCommandWaitDuration)
-		log.Printf("salt command:\n%v", strOut)
-		return false
-	}
-	log.Println("staying on for salt command to finish")
-	return true
-}
-
-func setStayOnUntil(newTime time.Time) error {
-	if time.Until(newTime) > 12*time.Hour {
-		return errors.New("can not delay over 12 hours")
-	}
-	mu.Lock()
-	if stayOnUntil.Before(newTime) {
-		stayOnUntil = newTime
-	}
-	mu.Unlock()
-	log.Println("staying on until", stayOnUntil.Format(time.UnixDate))
-	return nil
+	return minutes, false
 }
 
 type Args struct {
@@ -118,6 +73,23 @@ type Args struct {
 	SkipWait           bool   `arg:"-s,--skip-wait" help:"will not wait for the date to update"`
 	Timestamps         bool   `arg:"-t,--timestamps" help:"include timestamps in log output"`
 	SkipSystemShutdown bool   `arg:"--skip-system-shutdown" help:"don't shut down operating system when powering down"`
+
+	Simulate      bool    `arg:"--simulate" help:"print what the power schedule would do using a virtual clock and simulated ATtiny"`
+	SimulateDays  int     `arg:"--simulate-days" help:"number of days to simulate"`
+	SimulateStart string  `arg:"--simulate-start" help:"date (YYYY-MM-DD) to start the simulation from, defaults to now"`
+	Latitude      float64 `arg:"--latitude" help:"latitude to simulate at instead of the configured location"`
+	Longitude     float64 `arg:"--longitude" help:"longitude to simulate at instead of the configured location"`
+
+	Schedule *ScheduleCmd `arg:"subcommand:schedule" help:"print the upcoming power cycles and exit"`
+	History  *HistoryCmd  `arg:"subcommand:history" help:"print the past power cycles and exit"`
+}
+
+type HistoryCmd struct {
+	Count int `arg:"positional" default:"10" help:"number of power cycles to show"`
+}
+
+type ScheduleCmd struct {
+	Count int `arg:"positional" default:"5" help:"number of power cycles to show"`
 }
 
 func (Args) Version() string {
@@ -126,14 +98,42 @@ func (Args) Version() string {
 
 func procArgs() Args {
 	args := Args{
-		ConfigDir: config.DefaultConfigDir,
+		ConfigDir:    config.DefaultConfigDir,
+		SimulateDays: 30,
 	}
 	arg.MustParse(&args)
 	return args
 }
 
 func main() {
-	err := runMain()
+	args := procArgs()
+
+	if !args.Timestamps {
+		log.SetFlags(0)
+	}
+
+	if args.Schedule != nil {
+		if err := runSchedule(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if args.History != nil {
+		if err := runHistory(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if args.Simulate {
+		if err := runSimulation(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err := runMain(args)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -141,13 +141,7 @@ func main() {
 	runtime.Goexit()
 }
 
-func runMain() error {
-	args := procArgs()
-
-	if !args.Timestamps {
-		log.SetFlags(0)
-	}
-
+func runMain(args Args) error {
 	log.Printf("running version: %s", version)
 
 	conf, err := ParseConfig(args.ConfigDir)
@@ -155,6 +149,11 @@ func runMain() error {
 		log.Printf("error parsing config: %s\nwill try to just ping watchdog", err)
 		return justPingWatchdog()
 	}
+	heartbeatConf = conf.Heartbeat
+	heartbeatSinks, err = newHeartbeatSinks(conf.Heartbeat, conf.Device)
+	if err != nil {
+		return err
+	}
 
 	log.Println("connecting to attiny")
 	attiny, err := connectATtiny(conf.Battery)
@@ -166,6 +165,14 @@ func runMain() error {
 		return nil
 	}
 	log.Println("connected to attiny")
+	healthATtiny = attiny
+
+	if err := loadState(); err != nil {
+		log.Printf("failed to load state: %v", err)
+	}
+	restoreClock(attiny)
+	reportPowerOn(attiny.wakeReason)
+	startCycle(attiny.wakeReason)
 
 	if onBattery, err := attiny.checkIsOnBattery(); err != nil {
 		log.Println(err.Error())
@@ -176,12 +183,11 @@ func runMain() error {
 	}
 
 	log.Println("starting D-Bus service")
-	if err := startService(attiny); err != nil {
+	machine := newPowerMachine(conf, attiny, args.SkipWait, !args.SkipSystemShutdown)
+	if err := startService(attiny, conf, machine); err != nil {
 		return err
 	}
 	log.Println("started D-Bus service")
-	sendingHeartBeats := true
-	go heartBeatLoop(conf.OnWindow)
 	go updateWatchdogTimer(attiny)
 	if err := attiny.UpdateWifiState(); err != nil {
 		log.Println("failed to update wifi state:", err)
@@ -191,64 +197,133 @@ func runMain() error {
 		go batteryLoop(attiny)
 	}
 
-	log.Printf("on window: %s", conf.OnWindow)
+	return machine.run()
+}
 
-	if conf.OnWindow.NoWindow {
-		log.Printf("no window so pinging watchdog only")
-		runtime.Goexit()
+// requestPowerOff asks the ATtiny to power off until just before the next
+// window starts, saving the planned wake first.
+func requestPowerOff(conf *AttinyConfig, a powerOffer) error {
+	minutes, chained := powerOffMinutes(int(conf.OnWindow.Until().Minutes()), conf.Power)
+	now := clock.Now()
+	wakeAt := now.Add(time.Duration(minutes) * time.Minute)
+	if corrected := correctSleepMinutes(minutes); corrected != minutes {
+		log.Printf("correcting %d minutes to %d for the ATtiny sleep rate", minutes, corrected)
+		minutes = corrected
+	}
+	err := state.update(func(s *persistedState) {
+		s.ChainedSleepUntil = time.Time{}
+		if chained {
+			s.ChainedSleepUntil = conf.OnWindow.NextStart()
+		}
+		if s.Cycle != nil {
+			s.Cycle.PowerOff = now
+			s.Cycle.PowerOffMinutes = minutes
+			s.Cycle.WakeAt = wakeAt
+		}
+	})
+	if err != nil {
+		log.Printf("failed to save state: %v", err)
 	}
+	if chained {
+		log.Printf("longer than %d minutes until the window starts so will wake to power off again", maxSleepMinutes)
+	}
+	saveGoodTime(now, true)
+	log.Printf("requesting power off for %d minutes, waking at %s", minutes, wakeAt.Format(time.UnixDate))
+	if err := a.PowerOff(minutes); err != nil {
+		clearPowerOff()
+		return err
+	}
+	log.Println("power off requested")
+	return nil
+}
 
-	if !args.SkipWait {
-		log.Printf("waiting for %s before applying recording window", initialGracePeriod)
-		time.Sleep(initialGracePeriod)
+// requestFallbackPowerOff asks the ATtiny to power off for the untrusted-off
+// duration when the clock can't be trusted to work out the window. Nothing
+// is saved that depends on the time being right.
+func requestFallbackPowerOff(conf *AttinyConfig, a powerOffer) error {
+	minutes := int(conf.Power.UntrustedOffDuration.Minutes())
+	err := state.update(func(s *persistedState) {
+		s.ChainedSleepUntil = time.Time{}
+		if s.Cycle != nil {
+			s.Cycle.PowerOff = clock.Now()
+			s.Cycle.PowerOffMinutes = minutes
+		}
+	})
+	if err != nil {
+		log.Printf("failed to save state: %v", err)
+	}
+	log.Printf("clock not trusted for %s, requesting power off for %d minutes",
+		conf.Power.UntrustedOnDuration, minutes)
+	if err := a.PowerOff(minutes); err != nil {
+		clearPowerOff()
+		return err
 	}
+	log.Println("power off requested")
+	return nil
+}
 
-	for {
-		if conf.OnWindow.Active() {
-			if !sendingHeartBeats {
-				// means pi hasnt reboot and we need to start a new heartbeat loop
-				sendingHeartBeats = true
-				go heartBeatLoop(conf.OnWindow)
-			}
-			untilEnd := conf.OnWindow.UntilEnd()
-			log.Printf("%s until on window ends", untilEnd)
-			log.Println("sleeping until end of window")
-			time.Sleep(untilEnd - 3*time.Minute)
-			log.Println("making daytime-power-off event")
-			eventclient.AddEvent(eventclient.Event{
-				Timestamp: time.Now(),
-				Type:      "daytime-power-off",
-				Details: map[string]interface{}{
-					"powerOnAt": conf.OnWindow.NextStart(),
-				},
-			})
-			sendFinalHeartBeat(conf.OnWindow)
-			eventclient.UploadEvents() //Try to upload events before shutdown
-			time.Sleep(3 * time.Minute)
-			sendingHeartBeats = false
-		} else {
-			minutesUntilActive := int(conf.OnWindow.Until().Minutes())
-			log.Printf("minutes until active %d", minutesUntilActive)
-			if shouldTurnOff(minutesUntilActive) {
-				log.Println("syncing filesystems...")
-				unix.Sync()
-
-				log.Println("requesting power off...")
-				if err := attiny.PowerOff(minutesUntilActive - 2); err != nil {
-					log.Fatal(err)
-				}
-				log.Println("power off requested")
-
-				if !args.SkipSystemShutdown {
-					log.Println("shutting down system...")
-					if err := shutdown(); err != nil {
-						log.Fatal(err)
-					}
-				}
-			}
-			time.Sleep(time.Minute)
+// cancelPowerOff asks the ATtiny not to power off after all, as the system
+// couldn't be halted.
+func cancelPowerOff(a powerOffer) error {
+	clearPowerOff()
+	return a.CancelPowerOff()
+}
+
+// clearPowerOff removes the saved power off after the ATtiny didn't accept it.
+func clearPowerOff() {
+	err := state.update(func(s *persistedState) {
+		s.ChainedSleepUntil = time.Time{}
+		if s.Cycle != nil {
+			s.Cycle.PowerOff = time.Time{}
+			s.Cycle.PowerOffMinutes = 0
+			s.Cycle.WakeAt = time.Time{}
 		}
+	})
+	if err != nil {
+		log.Printf("failed to save state: %v", err)
+	}
+}
+
+// reportPowerOffFailed makes an event for the ATtiny not accepting a power
+// off, so the device has stayed on.
+func reportPowerOffFailed(powerOffErr error) {
+	log.Printf("%v, staying on and trying again in %s", powerOffErr, powerOffRetryInterval)
+	err := addEvent(eventclient.Event{
+		Timestamp: clock.Now(),
+		Type:      "power-off-failed",
+		Details: map[string]interface{}{
+			"error": powerOffErr.Error(),
+		},
+	})
+	if err != nil {
+		log.Printf("failed to make power-off-failed event: %v", err)
+	}
+}
+
+func runSchedule(args Args) error {
+	conf, err := ParseConfig(args.ConfigDir)
+	if err != nil {
+		return err
+	}
+	heartbeatConf = conf.Heartbeat
+	cycles, err := upcomingSchedule(conf.OnWindow, conf.Power, args.Schedule.Count, clock.Now())
+	if err != nil {
+		return err
+	}
+	printSchedule(os.Stdout, cycles)
+	return nil
+}
+
+func runHistory(args Args) error {
+	if err := loadState(); err != nil {
+		return err
+	}
+	cycles, err := powerHistory(args.History.Count)
+	if err != nil {
+		return err
 	}
+	printHistory(os.Stdout, cycles)
+	return nil
 }
 
 func updateWatchdogTimer(a *attiny) {
@@ -257,7 +332,7 @@ func updateWatchdogTimer(a *attiny) {
 		if err := a.PingWatchdog(); err != nil {
 			log.Fatal(err)
 		}
-		time.Sleep(time.Minute)
+		clock.Sleep(time.Minute)
 	}
 }
 
@@ -269,13 +344,13 @@ func batteryLoop(a *attiny) {
 			return
 		}
 		batteryVal, err := a.readBatteryValue()
-		nowStr := time.Now().Format("2006-01-02 15:04:05")
+		nowStr := clock.Now().Format("2006-01-02 15:04:05")
 		dataStr := fmt.Sprintf("%s, %f, %d\n", nowStr, cpu, batteryVal)
 		if err := appendToFile(dataStr, batteryCSVFile); err != nil {
 			log.Printf("error logging battery value: %s", err)
 			return
 		}
-		time.Sleep(batteryReadingInterval)
+		clock.Sleep(batteryReadingInterval)
 	}
 }
 
@@ -284,7 +359,7 @@ func cpuUsage() (float64, error) {
 	if err != nil {
 		return 0, err
 	}
-	time.Sleep(3 * time.Second)
+	clock.Sleep(3 * time.Second)
 	stat2, err := linuxproc.ReadStat(systemStatFile)
 	if err != nil {
 		return 0, err
@@ -324,15 +399,6 @@ func getTotalAndIdleTicks(c *linuxproc.CPUStat) (total, idle uint64) {
 	return total, idle
 }
 
-func shutdown() error {
-	cmd := exec.Command("/sbin/poweroff")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("poweroff failed: %v\n%s", err, output)
-	}
-	return nil
-}
-
 func justPingWatchdog() error {
 	attiny, err := connectATtiny(config.Battery{})
 	if err != nil {
@@ -0,0 +1,66 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// restoreGlobals puts back the package variables that tests replace once the
+// test finishes. It must be called before any of them are changed.
+func restoreGlobals(t *testing.T) {
+	origStatePath, origHistoryPath := statePath, historyPath
+	origClock := clock
+	origAddEvent, origUploadEvents := addEvent, uploadEvents
+	origRunningSaltJobs := runningSaltJobs
+	origCheckClockTrust, origNTPSynced, origRTCTime := checkClockTrust, ntpSynced, rtcTime
+	origClockFromATtiny, origSetSystemTime := clockFromATtiny, setSystemTime
+	origSystemUptime := systemUptime
+	origHeartbeatSender, origModemSignal := heartbeatSender, getModemConnectedSignal
+	origHeartbeatConf, origHeartbeatSinks := heartbeatConf, heartbeatSinks
+	origAPIClient, origConnRequester, origMQTTClient := newAPIClient, newConnRequester, newMQTTClient
+	origNotifyShuttingDown, origNotifyCancelled := notifyShuttingDown, notifyShutdownCancelled
+	origStopUnits, origStartUnits, origSyncDisks := stopUnits, startUnits, syncDisks
+	origLogind, origPoweroff := logindObject, poweroffCommand
+	t.Cleanup(func() {
+		statePath, historyPath = origStatePath, origHistoryPath
+		state = &persistedState{}
+		clock = origClock
+		addEvent, uploadEvents = origAddEvent, origUploadEvents
+		runningSaltJobs = origRunningSaltJobs
+		checkClockTrust, ntpSynced, rtcTime = origCheckClockTrust, origNTPSynced, origRTCTime
+		clockFromATtiny, setSystemTime = origClockFromATtiny, origSetSystemTime
+		systemUptime = origSystemUptime
+		heartbeatSender, getModemConnectedSignal = origHeartbeatSender, origModemSignal
+		heartbeatConf, heartbeatSinks = origHeartbeatConf, origHeartbeatSinks
+		heartbeats = newHeartbeatScheduler()
+		newAPIClient, newConnRequester, newMQTTClient = origAPIClient, origConnRequester, origMQTTClient
+		notifyShuttingDown, notifyShutdownCancelled = origNotifyShuttingDown, origNotifyCancelled
+		stopUnits, startUnits, syncDisks = origStopUnits, origStartUnits, origSyncDisks
+		logindObject, poweroffCommand = origLogind, origPoweroff
+		inhibitors = newShutdownInhibitors()
+	})
+}
+
+func TestPowerOffMinutes(t *testing.T) {
+	power := DefaultPower()
+	minutes, chained := powerOffMinutes(15, power)
+	assert.Equal(t, 13, minutes)
+	assert.False(t, chained)
+
+	minutes, chained = powerOffMinutes(maxSleepMinutes+2, power)
+	assert.Equal(t, maxSleepMinutes, minutes)
+	assert.False(t, chained)
+
+	minutes, chained = powerOffMinutes(maxSleepMinutes+3, power)
+	assert.Equal(t, maxSleepMinutes, minutes)
+	assert.True(t, chained)
+
+	power.WakeLead = 0
+	minutes, _ = powerOffMinutes(15, power)
+	assert.Equal(t, 15, minutes)
+}
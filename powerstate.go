@@ -0,0 +1,360 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+// powerState is where the device is in its on/off cycle.
+//
+// The device boots into stateBooting and, unless the wait is skipped, goes
+// through stateGracePeriod. From then on the schedule picks the next state:
+// stateClockUntrusted until the clock can be trusted, stateWindowActive while
+// the window is active, followed by stateWindowEnding as it ends, and
+// stateWaitingToPowerOff outside the window until nothing is keeping the
+// device on. Then statePoweringOff asks the ATtiny to power off, ending in
+// statePoweredOff, or going back to the schedule if the ATtiny didn't accept
+// it. If the clock stays untrusted for the untrusted-on duration
+// stateFallbackPoweringOff powers off for the untrusted-off duration instead.
+// Without a window the device goes straight to stateAlwaysOn.
+type powerState int
+
+const (
+	stateBooting powerState = iota
+	stateGracePeriod
+	stateClockUntrusted
+	stateWindowActive
+	stateWindowEnding
+	stateWaitingToPowerOff
+	statePoweringOff
+	stateFallbackPoweringOff
+	statePoweredOff
+	stateAlwaysOn
+)
+
+var powerStateNames = map[powerState]string{
+	stateBooting:             "booting",
+	stateGracePeriod:         "grace-period",
+	stateClockUntrusted:      "clock-untrusted",
+	stateWindowActive:        "window-active",
+	stateWindowEnding:        "window-ending",
+	stateWaitingToPowerOff:   "waiting-to-power-off",
+	statePoweringOff:         "powering-off",
+	stateFallbackPoweringOff: "fallback-powering-off",
+	statePoweredOff:          "powered-off",
+	stateAlwaysOn:            "always-on",
+}
+
+func (s powerState) String() string {
+	if name, ok := powerStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// final returns true if the power loop stops once it reaches the state.
+func (s powerState) final() bool {
+	return s == statePoweredOff || s == stateAlwaysOn
+}
+
+// powerInputs are what the next state is decided from. The schedule inputs,
+// clockTrusted, windowActive and turnOff, are only worked out when needed.
+type powerInputs struct {
+	noWindow  bool
+	skipGrace bool
+	// clockTrusted is false if the window can't be worked out yet.
+	clockTrusted bool
+	// untrustedTurnOff is true when the clock has been untrusted for too
+	// long and nothing is keeping the device on.
+	untrustedTurnOff bool
+	windowActive     bool
+	// turnOff is true when outside the window, the next window isn't too
+	// close and nothing is keeping the device on.
+	turnOff        bool
+	powerOffFailed bool
+}
+
+// nextPowerState gives the state to move to once the work for s is done.
+func nextPowerState(s powerState, in powerInputs) powerState {
+	switch s {
+	case stateBooting:
+		if in.noWindow {
+			return stateAlwaysOn
+		}
+		if !in.skipGrace {
+			return stateGracePeriod
+		}
+		return scheduledState(in)
+	case stateWindowActive:
+		return stateWindowEnding
+	case statePoweringOff, stateFallbackPoweringOff:
+		if !in.powerOffFailed {
+			return statePoweredOff
+		}
+		return scheduledState(in)
+	case stateGracePeriod, stateClockUntrusted, stateWindowEnding, stateWaitingToPowerOff:
+		return scheduledState(in)
+	}
+	return s
+}
+
+func scheduledState(in powerInputs) powerState {
+	switch {
+	case !in.clockTrusted && in.untrustedTurnOff:
+		return stateFallbackPoweringOff
+	case !in.clockTrusted:
+		return stateClockUntrusted
+	case in.windowActive:
+		return stateWindowActive
+	case in.turnOff:
+		return statePoweringOff
+	}
+	return stateWaitingToPowerOff
+}
+
+// powerMachine keeps the device on while the on window is active and asks the
+// ATtiny to power off until the next window starts when it isn't.
+type powerMachine struct {
+	conf           *AttinyConfig
+	attiny         powerOffer
+	skipWait       bool
+	systemShutdown bool
+	clockWatcher   clockWatcher
+	salt           saltWait
+	// untrustedSince is when the clock was first found to be untrusted.
+	untrustedSince time.Time
+
+	mu          sync.Mutex
+	state       powerState
+	stayOnUntil time.Time
+}
+
+func newPowerMachine(conf *AttinyConfig, a powerOffer, skipWait, systemShutdown bool) *powerMachine {
+	return &powerMachine{
+		conf:           conf,
+		attiny:         a,
+		skipWait:       skipWait,
+		systemShutdown: systemShutdown,
+	}
+}
+
+// State returns the current power state.
+func (m *powerMachine) State() powerState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// run moves through the power states until power off has been requested, or
+// straight away if there is no window.
+func (m *powerMachine) run() error {
+	for {
+		s := m.State()
+		in, err := m.step(s)
+		if err != nil {
+			return err
+		}
+		next := nextPowerState(s, in)
+		if next != s {
+			m.enter(s, next)
+		}
+		if next.final() {
+			return nil
+		}
+	}
+}
+
+func (m *powerMachine) enter(from, to powerState) {
+	log.Printf("power state %s -> %s", from, to)
+	m.mu.Lock()
+	m.state = to
+	m.mu.Unlock()
+	switch {
+	case from == stateClockUntrusted && to != stateFallbackPoweringOff:
+		// The heartbeats were worked out from the wrong time.
+		heartbeats.Reschedule(m.conf.OnWindow)
+	case from == stateFallbackPoweringOff:
+		// Still on after the fallback power off failed.
+		heartbeats.Start(m.conf.OnWindow)
+	}
+}
+
+// step does the work for state s and returns what is needed to decide the
+// next state.
+func (m *powerMachine) step(s powerState) (powerInputs, error) {
+	w := m.conf.OnWindow
+	in := powerInputs{}
+	switch s {
+	case stateBooting:
+		w.Now = clock.Now
+		heartbeats.Start(w)
+		log.Printf("on window: %s", w)
+		if w.NoWindow {
+			log.Printf("no window so only sending heartbeats and pinging watchdog")
+			in.noWindow = true
+			return in, nil
+		}
+		var chainedSleepUntil time.Time
+		state.get(func(s *persistedState) { chainedSleepUntil = s.ChainedSleepUntil })
+		if clock.Now().Before(chainedSleepUntil) && !w.Active() {
+			log.Printf("woke part way through a sleep until %s so not waiting before powering off again",
+				chainedSleepUntil.Format(time.UnixDate))
+			in.skipGrace = true
+		} else {
+			in.skipGrace = m.skipWait
+		}
+		if !in.skipGrace {
+			return in, nil
+		}
+
+	case stateGracePeriod:
+		log.Printf("waiting for %s before applying recording window", m.conf.Power.InitialGracePeriod)
+		clock.Sleep(m.conf.Power.InitialGracePeriod)
+
+	case stateClockUntrusted, stateWaitingToPowerOff:
+		// Without a trusted clock the window can't be worked out so stay on
+		// and keep checking.
+		clock.Sleep(time.Minute)
+
+	case stateWindowActive:
+		// Starts a new heartbeat loop if the window has opened again without
+		// the device powering off.
+		heartbeats.Start(w)
+		untilEnd := w.UntilEnd()
+		log.Printf("%s until on window ends", untilEnd)
+		plannedPowerOff := clock.Now().Add(untilEnd)
+		updateCycle(func(c *cycleRecord) { c.PlannedPowerOff = plannedPowerOff })
+		log.Println("sleeping until end of window")
+		clock.Sleep(untilEnd - m.conf.Power.WindowEndMargin)
+		return in, nil
+
+	case stateWindowEnding:
+		log.Println("making daytime-power-off event")
+		addEvent(eventclient.Event{
+			Timestamp: clock.Now(),
+			Type:      "daytime-power-off",
+			Details: map[string]interface{}{
+				"powerOnAt": w.NextStart(),
+			},
+		})
+		sendFinalHeartBeat(w)
+		uploadEvents() //Try to upload events before shutdown
+		clock.Sleep(m.conf.Power.WindowEndMargin)
+		heartbeats.Stop()
+
+	case statePoweringOff:
+		return m.powerOff(func() error {
+			return requestPowerOff(m.conf, m.attiny)
+		})
+
+	case stateFallbackPoweringOff:
+		return m.powerOff(func() error {
+			return requestFallbackPowerOff(m.conf, m.attiny)
+		})
+	}
+	m.scheduleInputs(&in)
+	return in, nil
+}
+
+// powerOff shuts down and asks the ATtiny to power off with request. If the
+// ATtiny doesn't accept it the device stays on and tries again later.
+func (m *powerMachine) powerOff(request func() error) (powerInputs, error) {
+	in := powerInputs{}
+	heartbeats.Stop()
+	err := powerDown(m.conf.Shutdown, request, func() error {
+		return cancelPowerOff(m.attiny)
+	}, m.systemShutdown)
+	var powerOffErr *powerOffError
+	if !errors.As(err, &powerOffErr) {
+		return in, err
+	}
+	reportPowerOffFailed(err)
+	clock.Sleep(powerOffRetryInterval)
+	in.powerOffFailed = true
+	m.scheduleInputs(&in)
+	return in, nil
+}
+
+// scheduleInputs checks the clock and the window for the next state.
+func (m *powerMachine) scheduleInputs(in *powerInputs) {
+	in.clockTrusted = m.clockWatcher.check()
+	if !in.clockTrusted {
+		now := clock.Now()
+		if m.untrustedSince.IsZero() {
+			m.untrustedSince = now
+		}
+		if now.Sub(m.untrustedSince) >= m.conf.Power.UntrustedOnDuration {
+			in.untrustedTurnOff = m.shouldTurnOff(int(m.conf.Power.UntrustedOffDuration.Minutes()))
+		}
+		return
+	}
+	m.untrustedSince = time.Time{}
+	in.windowActive = m.conf.OnWindow.Active()
+	if in.windowActive {
+		return
+	}
+	minutesUntilActive := int(m.conf.OnWindow.Until().Minutes())
+	log.Printf("minutes until active %d", minutesUntilActive)
+	in.turnOff = m.shouldTurnOff(minutesUntilActive)
+}
+
+func (m *powerMachine) shouldTurnOff(minutesUntilActive int) bool {
+	m.mu.Lock()
+	stayOnUntil := m.stayOnUntil
+	m.mu.Unlock()
+	turnOff := true
+	if clock.Now().Before(stayOnUntil) {
+		turnOff = false
+	} else if !longEnoughToPowerOff(minutesUntilActive, m.conf.Power) {
+		turnOff = false
+	}
+	if !turnOff {
+		m.salt.reset()
+		return false
+	}
+	return !m.salt.shouldStayOn(m.conf.Salt.DelayShutdownFunctions)
+}
+
+// longEnoughToPowerOff returns false if the window starts again too soon for
+// powering off to be worth it.
+func longEnoughToPowerOff(minutesUntilActive int, power Power) bool {
+	return minutesUntilActive >= int(power.MinOffDuration.Minutes())
+}
+
+// setStayOnUntil keeps the device on until newTime, unless it is already
+// staying on for longer.
+func (m *powerMachine) setStayOnUntil(newTime time.Time) error {
+	if newTime.Sub(clock.Now()) > 12*time.Hour {
+		return errors.New("can not delay over 12 hours")
+	}
+	m.mu.Lock()
+	if m.stayOnUntil.Before(newTime) {
+		m.stayOnUntil = newTime
+	}
+	stayOnUntil := m.stayOnUntil
+	m.mu.Unlock()
+	log.Println("staying on until", stayOnUntil.Format(time.UnixDate))
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextPowerState(t *testing.T) {
+	trusted := powerInputs{clockTrusted: true}
+	active := powerInputs{clockTrusted: true, windowActive: true}
+	turnOff := powerInputs{clockTrusted: true, turnOff: true}
+
+	tests := []struct {
+		name string
+		from powerState
+		in   powerInputs
+		want powerState
+	}{
+		{"no window", stateBooting, powerInputs{noWindow: true}, stateAlwaysOn},
+		{"boot", stateBooting, powerInputs{}, stateGracePeriod},
+		{"boot skipping wait", stateBooting, powerInputs{skipGrace: true, clockTrusted: true, turnOff: true}, statePoweringOff},
+		{"boot untrusted clock", stateBooting, powerInputs{skipGrace: true}, stateClockUntrusted},
+		{"grace in window", stateGracePeriod, active, stateWindowActive},
+		{"grace outside window", stateGracePeriod, trusted, stateWaitingToPowerOff},
+		{"grace turn off", stateGracePeriod, turnOff, statePoweringOff},
+		{"grace untrusted clock", stateGracePeriod, powerInputs{}, stateClockUntrusted},
+		{"still untrusted", stateClockUntrusted, powerInputs{}, stateClockUntrusted},
+		{"untrusted too long", stateClockUntrusted, powerInputs{untrustedTurnOff: true}, stateFallbackPoweringOff},
+		{"untrusted too long but trusted", stateClockUntrusted, powerInputs{clockTrusted: true, untrustedTurnOff: true, windowActive: true}, stateWindowActive},
+		{"clock trusted", stateClockUntrusted, active, stateWindowActive},
+		{"window active", stateWindowActive, powerInputs{}, stateWindowEnding},
+		{"window ended", stateWindowEnding, turnOff, statePoweringOff},
+		{"window ended staying on", stateWindowEnding, trusted, stateWaitingToPowerOff},
+		{"window opened again", stateWindowEnding, active, stateWindowActive},
+		{"still waiting", stateWaitingToPowerOff, trusted, stateWaitingToPowerOff},
+		{"done waiting", stateWaitingToPowerOff, turnOff, statePoweringOff},
+		{"window started while waiting", stateWaitingToPowerOff, active, stateWindowActive},
+		{"powered off", statePoweringOff, powerInputs{}, statePoweredOff},
+		{"power off failed", statePoweringOff, powerInputs{powerOffFailed: true, clockTrusted: true, turnOff: true}, statePoweringOff},
+		{"power off failed in window", statePoweringOff, powerInputs{powerOffFailed: true, clockTrusted: true, windowActive: true}, stateWindowActive},
+		{"fallback powered off", stateFallbackPoweringOff, powerInputs{}, statePoweredOff},
+		{"fallback failed", stateFallbackPoweringOff, powerInputs{powerOffFailed: true}, stateClockUntrusted},
+		{"fallback failed clock trusted", stateFallbackPoweringOff, powerInputs{powerOffFailed: true, clockTrusted: true, turnOff: true}, statePoweringOff},
+		{"stays powered off", statePoweredOff, turnOff, statePoweredOff},
+		{"stays always on", stateAlwaysOn, turnOff, stateAlwaysOn},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, nextPowerState(tc.from, tc.in))
+		})
+	}
+}
+
+func TestPowerStateNames(t *testing.T) {
+	for s := stateBooting; s <= stateAlwaysOn; s++ {
+		assert.NotEqual(t, "unknown", s.String())
+	}
+	assert.Equal(t, "window-active", stateWindowActive.String())
+	assert.Equal(t, "unknown", powerState(-1).String())
+}
+
+func newTestMachine(power Power) *powerMachine {
+	return newPowerMachine(&AttinyConfig{Power: power}, nil, false, false)
+}
+
+func TestShouldTurnOffMinOffDuration(t *testing.T) {
+	restoreGlobals(t)
+	runningSaltJobs = func() ([]saltJob, error) { return nil, nil }
+
+	m := newTestMachine(DefaultPower())
+	assert.False(t, m.shouldTurnOff(14))
+	assert.True(t, m.shouldTurnOff(15))
+
+	m.conf.Power.MinOffDuration = time.Hour
+	assert.False(t, m.shouldTurnOff(59))
+	assert.True(t, m.shouldTurnOff(60))
+}
+
+func TestStayOnUntil(t *testing.T) {
+	restoreGlobals(t)
+	c := &simClock{now: at(12, 0)}
+	clock = c
+	runningSaltJobs = func() ([]saltJob, error) { return nil, nil }
+
+	m := newTestMachine(DefaultPower())
+	assert.True(t, m.shouldTurnOff(60))
+	require.NoError(t, m.setStayOnUntil(at(13, 0)))
+	assert.False(t, m.shouldTurnOff(60))
+	// An earlier time doesn't cut it short.
+	require.NoError(t, m.setStayOnUntil(at(12, 30)))
+	c.Sleep(59 * time.Minute)
+	assert.False(t, m.shouldTurnOff(60))
+	c.Sleep(2 * time.Minute)
+	assert.True(t, m.shouldTurnOff(60))
+
+	assert.Error(t, m.setStayOnUntil(c.Now().Add(12*time.Hour+time.Minute)))
+}
+
+// recordingATtiny records when power off was requested and for how long. The
+// first failures requests fail.
+type recordingATtiny struct {
+	c         *simClock
+	failures  int
+	cancelled int
+	at        time.Time
+	minutes   int
+}
+
+func (a *recordingATtiny) PowerOff(minutes int) error {
+	if a.failures > 0 {
+		a.failures--
+		return errors.New("not counting down")
+	}
+	a.at = a.c.Now()
+	a.minutes = minutes
+	return nil
+}
+
+func (a *recordingATtiny) CancelPowerOff() error {
+	a.cancelled++
+	return nil
+}
+
+type noHeartbeats struct{}
+
+func (noHeartbeats) Start(*Schedule)         {}
+func (noHeartbeats) Stop()                   {}
+func (noHeartbeats) Reschedule(*Schedule)    {}
+func (noHeartbeats) Status() heartbeatStatus { return heartbeatStatus{} }
+
+// statesClock records the power state each time the machine sleeps.
+type statesClock struct {
+	simClock
+	m      *powerMachine
+	states []powerState
+}
+
+func (c *statesClock) Sleep(d time.Duration) {
+	if n := len(c.states); c.m != nil && (n == 0 || c.states[n-1] != c.m.State()) {
+		c.states = append(c.states, c.m.State())
+	}
+	c.simClock.Sleep(d)
+}
+
+func (c *statesClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// powerMachineRun is how the power machine is run by runPowerMachine.
+type powerMachineRun struct {
+	power    Power
+	start    time.Time
+	skipWait bool
+	// failures is how many power off requests fail.
+	failures int
+	// trusted is when the clock can be trusted, always if nil.
+	trusted func(now time.Time) bool
+}
+
+// powerMachineResult is what the power machine did until it powered off.
+type powerMachineResult struct {
+	attiny *recordingATtiny
+	states []powerState
+	events map[string]time.Time
+}
+
+// runPowerMachine runs the power machine for the 19:00 to 07:00 window on a
+// virtual clock from r.start until it powers off.
+func runPowerMachine(t *testing.T, r powerMachineRun) powerMachineResult {
+	restoreGlobals(t)
+	c := &statesClock{simClock: simClock{now: r.start}}
+	events := map[string]time.Time{}
+	statePath = ""
+	clock = c
+	addEvent = func(e eventclient.Event) error {
+		events[e.Type] = e.Timestamp
+		return nil
+	}
+	uploadEvents = func() error { return nil }
+	runningSaltJobs = func() ([]saltJob, error) { return nil, nil }
+	checkClockTrust = func(now time.Time) (bool, string) {
+		if r.trusted != nil && !r.trusted(now) {
+			return false, "test"
+		}
+		return true, ""
+	}
+	heartbeatSender = func(context.Context, time.Time, int, []heartbeatSink) error { return nil }
+	syncDisks = func() error { return nil }
+	heartbeats = noHeartbeats{}
+
+	conf := &AttinyConfig{
+		OnWindow: newScheduleAt(t, r.start, PowerWindow{PowerOn: "19:00", PowerOff: "07:00"}),
+		Power:    r.power,
+	}
+	a := &recordingATtiny{c: &c.simClock, failures: r.failures}
+	m := newPowerMachine(conf, a, r.skipWait, false)
+	c.m = m
+	require.NoError(t, m.run())
+	assert.Equal(t, statePoweredOff, m.State())
+	return powerMachineResult{attiny: a, states: c.states, events: events}
+}
+
+func TestPowerMachineStates(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   time.Time
+		trusted func(now time.Time) bool
+		want    []powerState
+		// offAt and offMinutes are checked if offMinutes is set.
+		offAt      time.Time
+		offMinutes int
+	}{
+		{
+			name:  "boot outside window",
+			start: at(12, 0),
+			want:  []powerState{stateGracePeriod},
+		},
+		{
+			name:  "boot before window",
+			start: at(18, 50),
+			want:  []powerState{stateGracePeriod, stateWindowActive, stateWindowEnding},
+		},
+		{
+			name:  "boot near end of window",
+			start: at(6, 0),
+			want:  []powerState{stateGracePeriod, stateWindowActive, stateWindowEnding},
+		},
+		{
+			name:    "clock trusted later",
+			start:   at(12, 0),
+			trusted: func(now time.Time) bool { return !now.Before(at(12, 25)) },
+			want:    []powerState{stateGracePeriod, stateClockUntrusted},
+		},
+		{
+			name:  "next window too close",
+			start: at(18, 30),
+			want:  []powerState{stateGracePeriod, stateWaitingToPowerOff, stateWindowActive, stateWindowEnding},
+		},
+		{
+			name:       "clock never trusted",
+			start:      at(12, 0),
+			trusted:    func(time.Time) bool { return false },
+			want:       []powerState{stateGracePeriod, stateClockUntrusted},
+			offAt:      at(13, 20),
+			offMinutes: 180,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := runPowerMachine(t, powerMachineRun{power: DefaultPower(), start: tc.start, trusted: tc.trusted})
+			assert.Equal(t, tc.want, r.states)
+			if tc.offMinutes != 0 {
+				assert.Equal(t, tc.offAt, r.attiny.at)
+				assert.Equal(t, tc.offMinutes, r.attiny.minutes)
+			}
+		})
+	}
+}
+
+func TestPowerMachineGracePeriodAndWakeLead(t *testing.T) {
+	r := runPowerMachine(t, powerMachineRun{power: DefaultPower(), start: at(12, 0)})
+	assert.Equal(t, at(12, 20), r.attiny.at)
+	assert.Equal(t, 400-2, r.attiny.minutes)
+
+	power := DefaultPower()
+	power.InitialGracePeriod = 30 * time.Minute
+	power.WakeLead = 5 * time.Minute
+	r = runPowerMachine(t, powerMachineRun{power: power, start: at(12, 0)})
+	assert.Equal(t, at(12, 30), r.attiny.at)
+	assert.Equal(t, 390-5, r.attiny.minutes)
+
+	power.InitialGracePeriod = 0
+	r = runPowerMachine(t, powerMachineRun{power: power, start: at(12, 0)})
+	assert.Equal(t, at(12, 0), r.attiny.at)
+}
+
+func TestPowerMachineEndMargin(t *testing.T) {
+	r := runPowerMachine(t, powerMachineRun{power: DefaultPower(), start: at(6, 0), skipWait: true})
+	assert.Equal(t, at(6, 57), r.events["daytime-power-off"])
+	assert.Equal(t, at(7, 0), r.attiny.at)
+	assert.Equal(t, 720-2, r.attiny.minutes)
+
+	power := DefaultPower()
+	power.WindowEndMargin = 10 * time.Minute
+	r = runPowerMachine(t, powerMachineRun{power: power, start: at(6, 0), skipWait: true})
+	assert.Equal(t, at(6, 50), r.events["daytime-power-off"])
+	assert.Equal(t, at(7, 0), r.attiny.at)
+}
+
+func TestPowerMachineRetriesFailedPowerOff(t *testing.T) {
+	r := runPowerMachine(t, powerMachineRun{power: DefaultPower(), start: at(12, 0), skipWait: true, failures: 2})
+	assert.Equal(t, at(12, 5), r.events["power-off-failed"])
+	assert.Equal(t, at(12, 10), r.attiny.at)
+	assert.Equal(t, 410-2, r.attiny.minutes)
+}
@@ -0,0 +1,183 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+const (
+	saltCommandWaitDuration = 30 * time.Minute
+	saltCallTimeout         = 20 * time.Second
+)
+
+// runningSaltJobs is a variable so it can be replaced when testing.
+var runningSaltJobs = querySaltJobs
+
+// saltWait tracks how long powering off has been delayed for salt jobs and
+// which jobs have been reported while waiting.
+type saltWait struct {
+	end      time.Time
+	reported map[string]bool
+}
+
+type saltJob struct {
+	JID string `json:"jid"`
+	Fun string `json:"fun"`
+	PID int    `json:"pid"`
+}
+
+func (j saltJob) String() string {
+	return fmt.Sprintf("%s (%s)", j.Fun, j.JID)
+}
+
+// shouldStayOn will check if a salt job worth delaying shutdown for is
+// running. If functions is empty then any running job will keep the device on.
+// If a device is being kept on for too long because of salt commands it will
+// ignore the salt command check.
+func (w *saltWait) shouldStayOn(functions []string) bool {
+	if w.end.IsZero() {
+		w.end = clock.Now().Add(saltCommandWaitDuration)
+	}
+
+	jobs, err := runningSaltJobs()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	jobs = filterSaltJobs(jobs, functions)
+	if len(jobs) == 0 {
+		return false
+	}
+
+	if clock.Now().After(w.end) {
+		log.Printf("waiting for salt command for too long (%v)", saltCommandWaitDuration)
+		log.Printf("salt jobs: %s", saltJobsString(jobs))
+		return false
+	}
+	log.Printf("staying on for salt jobs to finish: %s", saltJobsString(jobs))
+	w.report(jobs)
+	return true
+}
+
+// reset is called once the device is no longer trying to turn off so the next
+// attempt gets the full wait for salt jobs.
+func (w *saltWait) reset() {
+	w.end = time.Time{}
+	w.reported = nil
+}
+
+// report makes a stayed-on-for-salt event for any jobs that haven't already
+// been reported while waiting.
+func (w *saltWait) report(jobs []saltJob) {
+	if w.reported == nil {
+		w.reported = map[string]bool{}
+	}
+	newJobs := []map[string]interface{}{}
+	for _, job := range jobs {
+		if w.reported[job.JID] {
+			continue
+		}
+		w.reported[job.JID] = true
+		newJobs = append(newJobs, map[string]interface{}{
+			"jid": job.JID,
+			"fun": job.Fun,
+		})
+	}
+	if len(newJobs) == 0 {
+		return
+	}
+	err := addEvent(eventclient.Event{
+		Timestamp: clock.Now(),
+		Type:      "stayed-on-for-salt",
+		Details: map[string]interface{}{
+			"jobs":    newJobs,
+			"waitEnd": w.end,
+		},
+	})
+	if err != nil {
+		log.Printf("failed to make stayed-on-for-salt event: %v", err)
+	}
+}
+
+func querySaltJobs() ([]saltJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), saltCallTimeout)
+	defer cancel()
+
+	stdout, err := exec.CommandContext(ctx, "salt-call", "--local", "--out=json", "saltutil.running").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseSaltJobs(stdout)
+}
+
+// parseSaltJobs reads the jobs from the output of
+// `salt-call --out=json saltutil.running`. Anything printed before the JSON,
+// such as warnings, is ignored.
+func parseSaltJobs(out []byte) ([]saltJob, error) {
+	start := bytes.IndexByte(out, '{')
+	if start < 0 {
+		return nil, errors.New("no JSON found in salt-call output")
+	}
+	var minions map[string][]saltJob
+	if err := json.NewDecoder(bytes.NewReader(out[start:])).Decode(&minions); err != nil {
+		return nil, fmt.Errorf("failed to parse salt-call output: %v", err)
+	}
+	jobs := []saltJob{}
+	for _, minionJobs := range minions {
+		jobs = append(jobs, minionJobs...)
+	}
+	return jobs, nil
+}
+
+// filterSaltJobs returns the jobs running one of the given salt functions.
+// If no functions are given then all jobs are returned.
+func filterSaltJobs(jobs []saltJob, functions []string) []saltJob {
+	if len(functions) == 0 {
+		return jobs
+	}
+	filtered := []saltJob{}
+	for _, job := range jobs {
+		for _, f := range functions {
+			if job.Fun == f {
+				filtered = append(filtered, job)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func saltJobsString(jobs []saltJob) string {
+	s := make([]string, len(jobs))
+	for i, job := range jobs {
+		s[i] = job.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const saltRunningOutput = `[WARNING ] Unable to resolve address for salt master
+{
+    "local": [
+        {
+            "fun": "state.apply",
+            "jid": "20230405021512345678",
+            "pid": 1234
+        },
+        {
+            "fun": "test.ping",
+            "jid": "20230405021598765432",
+            "pid": 1240
+        }
+    ]
+}
+`
+
+func TestParseSaltJobs(t *testing.T) {
+	jobs, err := parseSaltJobs([]byte(saltRunningOutput))
+	require.NoError(t, err)
+	assert.Equal(t, []saltJob{
+		{JID: "20230405021512345678", Fun: "state.apply", PID: 1234},
+		{JID: "20230405021598765432", Fun: "test.ping", PID: 1240},
+	}, jobs)
+}
+
+func TestParseNoSaltJobs(t *testing.T) {
+	jobs, err := parseSaltJobs([]byte("{\n    \"local\": []\n}\n"))
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	_, err = parseSaltJobs([]byte("salt-call: command failed\n"))
+	assert.Error(t, err)
+}
+
+func TestFilterSaltJobs(t *testing.T) {
+	jobs, err := parseSaltJobs([]byte(saltRunningOutput))
+	require.NoError(t, err)
+
+	assert.Equal(t, jobs, filterSaltJobs(jobs, nil))
+	assert.Equal(t, jobs[:1], filterSaltJobs(jobs, []string{"state.apply", "pkg.upgrade"}))
+	assert.Empty(t, filterSaltJobs(jobs, []string{"pkg.upgrade"}))
+}
+
+func TestSaltWaitEnd(t *testing.T) {
+	restoreGlobals(t)
+	c := &simClock{now: at(12, 0)}
+	clock = c
+	runningSaltJobs = func() ([]saltJob, error) {
+		return []saltJob{{JID: "1", Fun: "state.apply"}}, nil
+	}
+	addEvent = func(eventclient.Event) error { return nil }
+
+	w := &saltWait{}
+	assert.True(t, w.shouldStayOn(nil))
+	c.Sleep(saltCommandWaitDuration - time.Minute)
+	assert.True(t, w.shouldStayOn(nil))
+	// Given up waiting.
+	c.Sleep(2 * time.Minute)
+	assert.False(t, w.shouldStayOn(nil))
+
+	w.reset()
+	assert.True(t, w.shouldStayOn(nil))
+}
+
+func TestSaltStayedOnReportedOnce(t *testing.T) {
+	restoreGlobals(t)
+	c := &simClock{now: at(12, 0)}
+	clock = c
+	jobs := []saltJob{{JID: "1", Fun: "state.apply"}}
+	runningSaltJobs = func() ([]saltJob, error) { return jobs, nil }
+	events := []eventclient.Event{}
+	addEvent = func(e eventclient.Event) error {
+		events = append(events, e)
+		return nil
+	}
+	reportedJIDs := func(e eventclient.Event) []string {
+		jids := []string{}
+		for _, job := range e.Details["jobs"].([]map[string]interface{}) {
+			jids = append(jids, job["jid"].(string))
+		}
+		return jids
+	}
+
+	// The job keeps running over several checks but is reported once.
+	w := &saltWait{}
+	for i := 0; i < 4; i++ {
+		assert.True(t, w.shouldStayOn(nil))
+		c.Sleep(5 * time.Minute)
+	}
+	require.Len(t, events, 1)
+	assert.Equal(t, "stayed-on-for-salt", events[0].Type)
+	assert.Equal(t, at(12, 0), events[0].Timestamp)
+	assert.Equal(t, at(12, 30), events[0].Details["waitEnd"])
+	assert.Equal(t, []string{"1"}, reportedJIDs(events[0]))
+
+	// Only a job that starts later is in the next event.
+	jobs = append(jobs, saltJob{JID: "2", Fun: "pkg.upgrade"})
+	assert.True(t, w.shouldStayOn(nil))
+	assert.True(t, w.shouldStayOn(nil))
+	require.Len(t, events, 2)
+	assert.Equal(t, []string{"2"}, reportedJIDs(events[1]))
+
+	// Once no longer trying to turn off the jobs are reported again.
+	w.reset()
+	assert.True(t, w.shouldStayOn(nil))
+	require.Len(t, events, 3)
+	assert.Equal(t, []string{"1", "2"}, reportedJIDs(events[2]))
+}
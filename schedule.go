@@ -0,0 +1,479 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/go-config"
+	sunrise "github.com/nathan-osman/go-sunrise"
+)
+
+const (
+	hourMinuteFormat = "15:04"
+
+	relativeToSunrise = "sunrise"
+	relativeToSunset  = "sunset"
+
+	monthDayFormat     = "01-02"
+	yearMonthDayFormat = "2006-01-02"
+
+	// How many days before now to look for windows that are still active.
+	scheduleLookBackDays = 2
+	// How many days ahead to look for the next window. Long enough for a
+	// window that is only active on one day each year.
+	scheduleLookAheadDays = 400
+	// The cached periods are cleared once they cover this many days so they
+	// don't keep growing on a device that stays on.
+	maxCachedDays = 2 * (scheduleLookBackDays + scheduleLookAheadDays + 1)
+)
+
+// NewSchedule creates a Schedule from a list of daily windows. Each window
+// power on and power off time can be a time of day ("06:30") or relative to
+// sunrise or sunset ("sunrise-1h", "sunset+30m"). A plain duration ("-30m")
+// is relative to sunset for power on and sunrise for power off, the same as
+// the windows config section. If a window with no day rules has the same
+// absolute power on and power off time the device is always on. Such a window
+// can't be mixed with others as it would hide them.
+func NewSchedule(windows []PowerWindow, lat, long float64) (*Schedule, error) {
+	if lat == 0 || long == 0 {
+		defLoc := config.DefaultWindowLocation()
+		lat = float64(defLoc.Latitude)
+		long = float64(defLoc.Longitude)
+	}
+	if len(windows) == 0 {
+		return nil, errors.New("no power windows given")
+	}
+
+	s := &Schedule{
+		latitude:  lat,
+		longitude: long,
+		Now:       now,
+		cache:     &periodCache{days: map[int64][]onPeriod{}},
+	}
+	for _, w := range windows {
+		start, err := parseTimeOfDay(w.PowerOn, relativeToSunset)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(w.PowerOff, relativeToSunrise)
+		if err != nil {
+			return nil, err
+		}
+		rule, err := parseDayRule(w)
+		if err != nil {
+			return nil, err
+		}
+		if start.relativeTo == "" && start == end && rule.everyDay() {
+			if len(windows) > 1 {
+				return nil, fmt.Errorf("power window %s to %s is always on so can't be used with other windows",
+					w.PowerOn, w.PowerOff)
+			}
+			return &Schedule{NoWindow: true, Now: now}, nil
+		}
+		s.windows = append(s.windows, dailyWindow{start: start, end: end, rule: rule})
+	}
+	if _, next := s.current(); next == nil {
+		return nil, fmt.Errorf("power windows don't start in the next %d days", scheduleLookAheadDays)
+	}
+	return s, nil
+}
+
+// Schedule is a set of windows that repeat each day, merged together where
+// they overlap. The device should be on while any window is active.
+// The Now field can be used to override the time source (for testing).
+type Schedule struct {
+	windows   []dailyWindow
+	latitude  float64
+	longitude float64
+	Now       func() time.Time
+	NoWindow  bool
+	cache     *periodCache
+}
+
+// periodCache holds the periods the windows give for each day, keyed by the
+// start of the day, as working them out means finding sunrise and sunset.
+// It is shared by copies of the schedule.
+type periodCache struct {
+	mu   sync.Mutex
+	days map[int64][]onPeriod
+	// computed counts the days worked out, for testing.
+	computed int
+}
+
+type dailyWindow struct {
+	start timeOfDay
+	end   timeOfDay
+	rule  dayRule
+}
+
+// dayRule limits which days a window starts on.
+type dayRule struct {
+	weekdays  map[time.Weekday]bool
+	from      time.Time
+	to        time.Time
+	every     int
+	everyFrom time.Time
+}
+
+// timeOfDay is either a time of day or an offset from sunrise or sunset.
+type timeOfDay struct {
+	hour       int
+	minute     int
+	relativeTo string
+	offset     time.Duration
+}
+
+type onPeriod struct {
+	start time.Time
+	end   time.Time
+}
+
+var weekdayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+func parseDayRule(w PowerWindow) (dayRule, error) {
+	rule := dayRule{every: w.Every}
+	if len(w.Days) > 0 {
+		rule.weekdays = map[time.Weekday]bool{}
+		for _, name := range w.Days {
+			weekdays, ok := weekdayNames[strings.ToLower(name)]
+			if !ok {
+				return rule, fmt.Errorf("unknown day '%s'", name)
+			}
+			for _, weekday := range weekdays {
+				rule.weekdays[weekday] = true
+			}
+		}
+	}
+
+	if (w.From == "") != (w.To == "") {
+		return rule, errors.New("power window needs both 'from' and 'to' dates")
+	}
+	if w.From != "" {
+		var err error
+		if rule.from, err = time.Parse(monthDayFormat, w.From); err != nil {
+			return rule, fmt.Errorf("could not parse '%s' as a month and day (MM-DD)", w.From)
+		}
+		if rule.to, err = time.Parse(monthDayFormat, w.To); err != nil {
+			return rule, fmt.Errorf("could not parse '%s' as a month and day (MM-DD)", w.To)
+		}
+	}
+
+	if w.Every < 0 {
+		return rule, fmt.Errorf("invalid power window 'every' of %d", w.Every)
+	}
+	if w.EveryFrom != "" {
+		var err error
+		if rule.everyFrom, err = time.Parse(yearMonthDayFormat, w.EveryFrom); err != nil {
+			return rule, fmt.Errorf("could not parse '%s' as a date (YYYY-MM-DD)", w.EveryFrom)
+		}
+	} else {
+		rule.everyFrom = time.Unix(0, 0).UTC()
+	}
+	return rule, nil
+}
+
+func (r dayRule) everyDay() bool {
+	return r.weekdays == nil && r.from.IsZero() && r.every <= 1
+}
+
+// matches returns true if a window can start on the given day.
+func (r dayRule) matches(day time.Time) bool {
+	if r.weekdays != nil && !r.weekdays[day.Weekday()] {
+		return false
+	}
+	if !r.from.IsZero() {
+		md := monthDay(day)
+		from := monthDay(r.from)
+		to := monthDay(r.to)
+		if from <= to && (md < from || md > to) {
+			return false
+		}
+		// The range goes over the new year.
+		if from > to && md < from && md > to {
+			return false
+		}
+	}
+	if r.every > 1 {
+		date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+		days := int(date.Sub(r.everyFrom).Hours() / 24)
+		if days%r.every != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func monthDay(t time.Time) int {
+	return int(t.Month())*100 + t.Day()
+}
+
+func (r dayRule) String() string {
+	rules := []string{}
+	if r.weekdays != nil {
+		days := []string{}
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if r.weekdays[d] {
+				days = append(days, d.String()[:3])
+			}
+		}
+		rules = append(rules, "on "+strings.Join(days, ", "))
+	}
+	if !r.from.IsZero() {
+		rules = append(rules, fmt.Sprintf("from %s to %s", r.from.Format("2 Jan"), r.to.Format("2 Jan")))
+	}
+	if r.every > 1 {
+		rules = append(rules, fmt.Sprintf("every %d days from %s", r.every, r.everyFrom.Format(yearMonthDayFormat)))
+	}
+	return strings.Join(rules, " ")
+}
+
+func parseTimeOfDay(s, defaultRelativeTo string) (timeOfDay, error) {
+	if t, err := time.Parse(hourMinuteFormat, s); err == nil {
+		return timeOfDay{hour: t.Hour(), minute: t.Minute()}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return timeOfDay{relativeTo: defaultRelativeTo, offset: d}, nil
+	}
+	for _, relativeTo := range []string{relativeToSunrise, relativeToSunset} {
+		if !strings.HasPrefix(s, relativeTo) {
+			continue
+		}
+		t := timeOfDay{relativeTo: relativeTo}
+		if offset := strings.TrimPrefix(s, relativeTo); offset != "" {
+			d, err := time.ParseDuration(offset)
+			if err != nil {
+				break
+			}
+			t.offset = d
+		}
+		return t, nil
+	}
+	return timeOfDay{}, fmt.Errorf("could not parse '%s' as a time, duration or sunrise/sunset offset", s)
+}
+
+// on returns the time on the given day.
+func (t timeOfDay) on(day time.Time, lat, long float64) time.Time {
+	switch t.relativeTo {
+	case relativeToSunrise:
+		sr, _ := sunrise.SunriseSunset(lat, long, day.Year(), day.Month(), day.Day())
+		return sr.Add(t.offset)
+	case relativeToSunset:
+		_, ss := sunrise.SunriseSunset(lat, long, day.Year(), day.Month(), day.Day())
+		return ss.Add(t.offset)
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), t.hour, t.minute, 0, 0, day.Location())
+}
+
+func (t timeOfDay) String() string {
+	if t.relativeTo == "" {
+		return fmt.Sprintf("%02d:%02d", t.hour, t.minute)
+	}
+	if t.offset == 0 {
+		return t.relativeTo
+	}
+	if t.offset < 0 {
+		return fmt.Sprintf("%v before %s", -t.offset, t.relativeTo)
+	}
+	return fmt.Sprintf("%v after %s", t.offset, t.relativeTo)
+}
+
+// onPeriods gives the merged periods the device should be on around now,
+// sorted by start time. It looks ahead until it has found the next period to
+// start after now. Each day is only worked out once.
+func (s *Schedule) onPeriods(now time.Time) []onPeriod {
+	all := []onPeriod{}
+	var nextStart time.Time
+	for d := -scheduleLookBackDays; d <= scheduleLookAheadDays; d++ {
+		day := time.Date(now.Year(), now.Month(), now.Day()+d, 0, 0, 0, 0, now.Location())
+		if !nextStart.IsZero() && day.After(nextStart.AddDate(0, 0, 1)) {
+			break
+		}
+		for _, p := range s.dayPeriods(day) {
+			all = append(all, p)
+			if p.start.After(now) && (nextStart.IsZero() || p.start.Before(nextStart)) {
+				nextStart = p.start
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].start.Before(all[j].start)
+	})
+
+	merged := []onPeriod{}
+	for _, p := range all {
+		last := len(merged) - 1
+		if last >= 0 && !p.start.After(merged[last].end) {
+			if p.end.After(merged[last].end) {
+				merged[last].end = p.end
+			}
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// dayPeriods gives the periods for the windows that start on day, from the
+// cache if they have already been worked out.
+func (s *Schedule) dayPeriods(day time.Time) []onPeriod {
+	if s.cache != nil {
+		s.cache.mu.Lock()
+		defer s.cache.mu.Unlock()
+		if periods, ok := s.cache.days[day.Unix()]; ok {
+			return periods
+		}
+	}
+	periods := []onPeriod{}
+	for _, w := range s.windows {
+		if !w.rule.matches(day) {
+			continue
+		}
+		start := w.start.on(day, s.latitude, s.longitude)
+		end := w.end.on(day, s.latitude, s.longitude)
+		if !end.After(start) {
+			end = w.end.on(day.AddDate(0, 0, 1), s.latitude, s.longitude)
+		}
+		periods = append(periods, onPeriod{start: start, end: end})
+	}
+	if s.cache != nil {
+		if len(s.cache.days) >= maxCachedDays {
+			s.cache.days = map[int64][]onPeriod{}
+		}
+		s.cache.days[day.Unix()] = periods
+		s.cache.computed++
+	}
+	return periods
+}
+
+// current returns the period active now and the next period to start.
+// Either can be nil.
+func (s *Schedule) current() (active, next *onPeriod) {
+	now := s.Now()
+	periods := s.onPeriods(now)
+	for i := range periods {
+		p := &periods[i]
+		if p.start.After(now) {
+			return active, p
+		}
+		if p.end.After(now) {
+			active = p
+		}
+	}
+	return active, nil
+}
+
+// Active returns true if a window is currently active.
+func (s *Schedule) Active() bool {
+	if s.NoWindow {
+		return true
+	}
+	active, _ := s.current()
+	return active != nil
+}
+
+// Until returns the duration until the next window starts.
+func (s *Schedule) Until() time.Duration {
+	if s.NoWindow || s.Active() {
+		return time.Duration(0)
+	}
+	return s.NextStart().Sub(s.Now())
+}
+
+// UntilEnd returns the duration until the active window ends.
+func (s *Schedule) UntilEnd() time.Duration {
+	if s.NoWindow {
+		return time.Duration(0)
+	}
+	active, _ := s.current()
+	if active == nil {
+		return time.Duration(0)
+	}
+	return active.end.Sub(s.Now())
+}
+
+// NextStart gives the next time a window will start.
+func (s *Schedule) NextStart() time.Time {
+	_, next := s.current()
+	if next == nil {
+		return time.Time{}
+	}
+	return next.start
+}
+
+// NextEnd gives the next time a window will end.
+func (s *Schedule) NextEnd() time.Time {
+	active, next := s.current()
+	if active != nil {
+		return active.end
+	}
+	if next != nil {
+		return next.end
+	}
+	return time.Time{}
+}
+
+// PreviousStart gives the time the active window started, or the last
+// window started if none is active.
+func (s *Schedule) PreviousStart() time.Time {
+	now := s.Now()
+	var start time.Time
+	for _, p := range s.onPeriods(now) {
+		if p.start.After(now) {
+			break
+		}
+		start = p.start
+	}
+	return start
+}
+
+func (s Schedule) String() string {
+	if s.NoWindow {
+		return "no window set"
+	}
+	day := s.Now()
+	windows := make([]string, len(s.windows))
+	for i, w := range s.windows {
+		windows[i] = fmt.Sprintf("%s to %s", w.start, w.end)
+		if w.start.relativeTo != "" || w.end.relativeTo != "" {
+			windows[i] += fmt.Sprintf(" (%s to %s today)",
+				w.start.on(day, s.latitude, s.longitude).Local().Format(hourMinuteFormat),
+				w.end.on(day, s.latitude, s.longitude).Local().Format(hourMinuteFormat))
+		}
+		if rule := w.rule.String(); rule != "" {
+			windows[i] += " " + rule
+		}
+	}
+	return "windows " + strings.Join(windows, ", ")
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newScheduleAt(t *testing.T, now time.Time, windows ...PowerWindow) *Schedule {
+	s, err := NewSchedule(windows, -43.5321, 172.6362)
+	require.NoError(t, err)
+	s.Now = func() time.Time { return now }
+	return s
+}
+
+func at(hour, minute int) time.Time {
+	return time.Date(2026, 6, 1, hour, minute, 0, 0, time.Local)
+}
+
+func TestScheduleSingleWindow(t *testing.T) {
+	s := newScheduleAt(t, at(12, 0), PowerWindow{PowerOn: "18:00", PowerOff: "06:00"})
+	assert.False(t, s.Active())
+	assert.Equal(t, 6*time.Hour, s.Until())
+	assert.Equal(t, at(18, 0), s.NextStart())
+	assert.Equal(t, at(30, 0), s.NextEnd())
+
+	s.Now = func() time.Time { return at(23, 0) }
+	assert.True(t, s.Active())
+	assert.Equal(t, 7*time.Hour, s.UntilEnd())
+	assert.Equal(t, at(18, 0), s.PreviousStart())
+	assert.Equal(t, at(42, 0), s.NextStart())
+}
+
+func TestScheduleMultipleWindows(t *testing.T) {
+	windows := []PowerWindow{
+		{PowerOn: "05:00", PowerOff: "08:00"},
+		{PowerOn: "17:00", PowerOff: "20:00"},
+	}
+	s := newScheduleAt(t, at(6, 0), windows...)
+	assert.True(t, s.Active())
+	assert.Equal(t, at(8, 0), s.NextEnd())
+	assert.Equal(t, at(17, 0), s.NextStart())
+
+	s.Now = func() time.Time { return at(12, 0) }
+	assert.False(t, s.Active())
+	assert.Equal(t, 5*time.Hour, s.Until())
+	assert.Equal(t, at(20, 0), s.NextEnd())
+
+	s.Now = func() time.Time { return at(21, 0) }
+	assert.False(t, s.Active())
+	assert.Equal(t, at(29, 0), s.NextStart())
+}
+
+func TestScheduleOverlappingWindowsMerge(t *testing.T) {
+	s := newScheduleAt(t, at(7, 0),
+		PowerWindow{PowerOn: "05:00", PowerOff: "08:00"},
+		PowerWindow{PowerOn: "07:30", PowerOff: "10:00"},
+		PowerWindow{PowerOn: "10:00", PowerOff: "11:00"})
+	assert.True(t, s.Active())
+	assert.Equal(t, at(11, 0), s.NextEnd())
+	assert.Equal(t, at(5, 0), s.PreviousStart())
+}
+
+func TestScheduleRelativeWindows(t *testing.T) {
+	s := newScheduleAt(t, at(12, 0),
+		PowerWindow{PowerOn: "sunrise-1h", PowerOff: "sunrise+2h"},
+		PowerWindow{PowerOn: "-30m", PowerOff: "sunset+1h"})
+	sunriseToday := s.windows[0].start.on(at(0, 0), s.latitude, s.longitude).Add(time.Hour)
+	sunsetToday := s.windows[1].end.on(at(0, 0), s.latitude, s.longitude).Add(-time.Hour)
+
+	s.Now = func() time.Time { return sunriseToday }
+	assert.True(t, s.Active())
+	assert.Equal(t, 2*time.Hour, s.UntilEnd())
+	assert.Equal(t, sunriseToday.Add(-time.Hour), s.PreviousStart())
+
+	s.Now = func() time.Time { return sunsetToday.Add(-2 * time.Hour) }
+	assert.False(t, s.Active())
+	assert.Equal(t, sunsetToday.Add(-30*time.Minute), s.NextStart())
+	assert.Equal(t, sunsetToday.Add(time.Hour), s.NextEnd())
+}
+
+func TestScheduleNoWindow(t *testing.T) {
+	s := newScheduleAt(t, at(12, 0), PowerWindow{PowerOn: "12:00", PowerOff: "12:00"})
+	assert.True(t, s.NoWindow)
+	assert.True(t, s.Active())
+	assert.Equal(t, time.Duration(0), s.Until())
+}
+
+func TestScheduleAlwaysOnWithOtherWindows(t *testing.T) {
+	_, err := NewSchedule([]PowerWindow{
+		{PowerOn: "sunset-1h", PowerOff: "sunset+1h"},
+		{PowerOn: "12:00", PowerOff: "12:00"},
+	}, 0, 0)
+	assert.EqualError(t, err, "power window 12:00 to 12:00 is always on so can't be used with other windows")
+
+	// With day rules it is a 24 hour window on those days instead.
+	s := newScheduleAt(t, at(12, 0),
+		PowerWindow{PowerOn: "19:00", PowerOff: "07:00"},
+		PowerWindow{PowerOn: "12:00", PowerOff: "12:00", Days: []string{"weekends"}})
+	assert.False(t, s.NoWindow)
+	// 1 June 2026 is a Monday.
+	assert.False(t, s.Active())
+	assert.Equal(t, at(19, 0), s.NextStart())
+	s.Now = func() time.Time { return at(12, 0).AddDate(0, 0, 5) }
+	assert.True(t, s.Active())
+	assert.Equal(t, at(12, 0).AddDate(0, 0, 7), s.NextEnd())
+}
+
+func TestScheduleInvalidTime(t *testing.T) {
+	_, err := NewSchedule([]PowerWindow{{PowerOn: "sunrise+abc", PowerOff: "06:00"}}, 0, 0)
+	assert.Error(t, err)
+	_, err = NewSchedule([]PowerWindow{{PowerOn: "noon", PowerOff: "06:00"}}, 0, 0)
+	assert.Error(t, err)
+	_, err = NewSchedule(nil, 0, 0)
+	assert.Error(t, err)
+}
+
+func TestScheduleWeekdays(t *testing.T) {
+	// 2026-06-05 is a Friday.
+	friday := time.Date(2026, 6, 5, 12, 0, 0, 0, time.Local)
+	s := newScheduleAt(t, friday, PowerWindow{PowerOn: "18:00", PowerOff: "06:00", Days: []string{"weekdays"}})
+	assert.Equal(t, friday.Add(6*time.Hour), s.NextStart())
+
+	s.Now = func() time.Time { return friday.Add(14 * time.Hour) }
+	assert.True(t, s.Active(), "window started on Friday should go into Saturday")
+	assert.Equal(t, friday.AddDate(0, 0, 3).Add(6*time.Hour), s.NextStart())
+
+	s.Now = func() time.Time { return friday.AddDate(0, 0, 1) }
+	assert.False(t, s.Active())
+	assert.Equal(t, 54*time.Hour, s.Until())
+}
+
+func TestScheduleDateRange(t *testing.T) {
+	windows := PowerWindow{PowerOn: "18:00", PowerOff: "22:00", From: "09-01", To: "11-30"}
+	s := newScheduleAt(t, time.Date(2026, 6, 1, 12, 0, 0, 0, time.Local), windows)
+	assert.Equal(t, time.Date(2026, 9, 1, 18, 0, 0, 0, time.Local), s.NextStart())
+
+	s.Now = func() time.Time { return time.Date(2026, 11, 30, 19, 0, 0, 0, time.Local) }
+	assert.True(t, s.Active())
+	assert.Equal(t, time.Date(2027, 9, 1, 18, 0, 0, 0, time.Local), s.NextStart())
+
+	// Range over the new year.
+	windows.From, windows.To = "12-01", "01-31"
+	s = newScheduleAt(t, time.Date(2026, 1, 31, 12, 0, 0, 0, time.Local), windows)
+	assert.Equal(t, time.Date(2026, 1, 31, 18, 0, 0, 0, time.Local), s.NextStart())
+	s.Now = func() time.Time { return time.Date(2026, 2, 1, 12, 0, 0, 0, time.Local) }
+	assert.Equal(t, time.Date(2026, 12, 1, 18, 0, 0, 0, time.Local), s.NextStart())
+}
+
+func TestScheduleEveryThirdNight(t *testing.T) {
+	windows := PowerWindow{PowerOn: "20:00", PowerOff: "04:00", Every: 3, EveryFrom: "2026-06-01"}
+	s := newScheduleAt(t, at(12, 0), windows)
+	assert.Equal(t, at(20, 0), s.NextStart())
+
+	s.Now = func() time.Time { return at(23, 0) }
+	assert.True(t, s.Active())
+	assert.Equal(t, at(3*24+20, 0), s.NextStart())
+}
+
+func TestScheduleLookAheadCached(t *testing.T) {
+	// Only on one day each year, so finding the next window looks most of
+	// a year ahead.
+	s := newScheduleAt(t, at(12, 0).AddDate(0, 0, 2),
+		PowerWindow{PowerOn: "sunset", PowerOff: "sunrise", From: "06-01", To: "06-01"})
+	computed := s.cache.computed
+	assert.Equal(t, at(12, 0).AddDate(1, 0, 0).Format("2006-01-02"), s.NextStart().Format("2006-01-02"))
+	firstLookAhead := s.cache.computed - computed
+	assert.LessOrEqual(t, firstLookAhead, scheduleLookBackDays+scheduleLookAheadDays+1)
+
+	computed = s.cache.computed
+	for i := 0; i < 10; i++ {
+		s.Active()
+		s.Until()
+		s.UntilEnd()
+		s.NextStart()
+		s.NextEnd()
+		s.PreviousStart()
+	}
+	assert.Equal(t, computed, s.cache.computed)
+
+	// The days looked at a day later have all been worked out already.
+	s.Now = func() time.Time { return at(12, 0).AddDate(0, 0, 3) }
+	s.NextStart()
+	assert.Equal(t, computed, s.cache.computed)
+}
+
+func TestScheduleInvalidRules(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		window PowerWindow
+		err    string
+	}{
+		{"unknown day", PowerWindow{Days: []string{"someday"}}, "unknown day 'someday'"},
+		{"from without to", PowerWindow{From: "09-01"}, "power window needs both 'from' and 'to' dates"},
+		{"bad to", PowerWindow{From: "09-01", To: "31-11"}, "could not parse '31-11' as a month and day (MM-DD)"},
+		{"negative every", PowerWindow{Every: -1}, "invalid power window 'every' of -1"},
+		{"bad every from", PowerWindow{Every: 2, EveryFrom: "2026-13-01"}, "could not parse '2026-13-01' as a date (YYYY-MM-DD)"},
+		// Every 7 days from a Monday is only ever a Monday.
+		{"never active", PowerWindow{Days: []string{"tue"}, Every: 7, EveryFrom: "2026-06-01"},
+			"power windows don't start in the next 400 days"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := tc.window
+			w.PowerOn, w.PowerOff = "18:00", "06:00"
+			_, err := NewSchedule([]PowerWindow{w}, 0, 0)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
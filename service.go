@@ -19,6 +19,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -33,10 +34,14 @@ const (
 )
 
 type service struct {
-	attiny *attiny
+	attiny    *attiny
+	window    *Schedule
+	power     Power
+	heartbeat HeartbeatConfig
+	machine   *powerMachine
 }
 
-func startService(a *attiny) error {
+func startService(a *attiny, conf *AttinyConfig, machine *powerMachine) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return err
@@ -50,9 +55,19 @@ func startService(a *attiny) error {
 	}
 
 	s := &service{
-		attiny: a,
+		attiny:    a,
+		window:    conf.OnWindow,
+		power:     conf.Power,
+		heartbeat: conf.Heartbeat,
+		machine:   machine,
 	}
 	conn.Export(s, dbusPath, dbusName)
+	notifyShuttingDown = func() error {
+		return conn.Emit(dbusPath, dbusName+".ShuttingDown")
+	}
+	notifyShutdownCancelled = func() error {
+		return conn.Emit(dbusPath, dbusName+".ShutdownCancelled")
+	}
 	conn.Export(genIntrospectable(s), dbusPath, "org.freedesktop.DBus.Introspectable")
 	return nil
 }
@@ -62,6 +77,7 @@ func genIntrospectable(v interface{}) introspect.Introspectable {
 		Interfaces: []introspect.Interface{{
 			Name:    dbusName,
 			Methods: introspect.Methods(v),
+			Signals: []introspect.Signal{{Name: "ShuttingDown"}, {Name: "ShutdownCancelled"}},
 		}},
 	}
 	return introspect.NewIntrospectable(node)
@@ -74,7 +90,7 @@ func (s service) IsPresent() (bool, *dbus.Error) {
 
 // StayOnFor will delay turning off the raspberry pi for m minutes.
 func (s service) StayOnFor(m int) *dbus.Error {
-	err := setStayOnUntil(time.Now().Add(time.Duration(m) * time.Minute))
+	err := s.machine.setStayOnUntil(clock.Now().Add(time.Duration(m) * time.Minute))
 	if err != nil {
 		return makeDbusError(".StayOnForError", err)
 	}
@@ -105,6 +121,108 @@ func (s service) OnBattery() (bool, *dbus.Error) {
 	return onBattery, nil
 }
 
+// WakeReason returns why the ATtiny last powered on the Pi, such as
+// "scheduled" or "watchdog".
+func (s service) WakeReason() (string, *dbus.Error) {
+	if err := s.ensureATtinyPresent(); err != nil {
+		return "", makeDbusError(".WakeReason", err)
+	}
+	return s.attiny.wakeReason.String(), nil
+}
+
+// Status returns the power window and the power and heartbeat settings as
+// JSON.
+func (s service) Status() (string, *dbus.Error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"state":              s.machine.State().String(),
+		"window":             s.window.String(),
+		"wakeLead":           s.power.WakeLead.String(),
+		"minOffDuration":     s.power.MinOffDuration.String(),
+		"windowEndMargin":    s.power.WindowEndMargin.String(),
+		"initialGracePeriod": s.power.InitialGracePeriod.String(),
+		"heartbeat": map[string]interface{}{
+			"initialDelay":            s.heartbeat.InitialDelay.String(),
+			"interval":                s.heartbeat.Interval.String(),
+			"penultimateBeforeEnd":    s.heartbeat.PenultimateBeforeEnd.String(),
+			"maxAttempts":             s.heartbeat.MaxAttempts,
+			"attemptDelay":            s.heartbeat.AttemptDelay.String(),
+			"connectionTimeout":       s.heartbeat.ConnTimeout.String(),
+			"connectionRetryInterval": s.heartbeat.ConnRetryInterval.String(),
+			"connectionMaxRetries":    s.heartbeat.ConnMaxRetries,
+			"sinks":                   s.heartbeat.Sinks,
+		},
+	})
+	if err != nil {
+		return "", makeDbusError(".Status", err)
+	}
+	return string(b), nil
+}
+
+// PowerState returns where the device is in its power cycle, for example
+// "window-active" or "waiting-to-power-off".
+func (s service) PowerState() (string, *dbus.Error) {
+	return s.machine.State().String(), nil
+}
+
+// HeartbeatStatus returns whether heartbeats are being sent, the validUntil
+// of the last heartbeat and when the next will be sent as JSON.
+func (s service) HeartbeatStatus() (string, *dbus.Error) {
+	b, err := json.Marshal(heartbeats.Status())
+	if err != nil {
+		return "", makeDbusError(".HeartbeatStatus", err)
+	}
+	return string(b), nil
+}
+
+// UpcomingSchedule returns the next n power cycles, up to 100, as JSON. Each
+// has the power on and off times, the minutes the ATtiny will be asked to
+// power off for and the validUntil times of the heartbeats sent. Short gaps
+// between windows are stayed on through and each wake from a chained sleep
+// is a cycle of its own.
+func (s service) UpcomingSchedule(n int) (string, *dbus.Error) {
+	cycles, err := upcomingSchedule(s.window, s.power, n, clock.Now())
+	if err != nil {
+		return "", makeDbusError(".UpcomingSchedule", err)
+	}
+	b, err := json.Marshal(cycles)
+	if err != nil {
+		return "", makeDbusError(".UpcomingSchedule", err)
+	}
+	return string(b), nil
+}
+
+// PowerHistory returns the last n power cycles, up to 100, as JSON, ending
+// with the current one.
+func (s service) PowerHistory(n int) (string, *dbus.Error) {
+	cycles, err := powerHistory(n)
+	if err != nil {
+		return "", makeDbusError(".PowerHistory", err)
+	}
+	b, err := json.Marshal(cycles)
+	if err != nil {
+		return "", makeDbusError(".PowerHistory", err)
+	}
+	return string(b), nil
+}
+
+// InhibitShutdown stops the device powering off until ReleaseShutdown is
+// called with the same name. If it isn't released by the shutdown timeout
+// powering off is cancelled and tried again later. Inhibitors are dropped
+// after an hour and only 10 can be held at once. The D-Bus policy only lets
+// root call it.
+func (s service) InhibitShutdown(name string) *dbus.Error {
+	if err := inhibitors.inhibit(name); err != nil {
+		return makeDbusError(".InhibitShutdown", err)
+	}
+	return nil
+}
+
+// ReleaseShutdown lets the device power off again.
+func (s service) ReleaseShutdown(name string) *dbus.Error {
+	inhibitors.release(name)
+	return nil
+}
+
 func (s service) UpdateWifiState() *dbus.Error {
 	if err := s.attiny.UpdateWifiState(); err != nil {
 		return makeDbusError(".UpdateWifiState", err)
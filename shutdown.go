@@ -0,0 +1,361 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	meminfoFile = "/proc/meminfo"
+
+	// Filesystems are counted as synced once there is no more than this
+	// much dirty data left.
+	maxDirtyKB   = 1024
+	syncAttempts = 3
+
+	// InhibitShutdown can be called by any local user so the number of
+	// inhibitors and how long each can hold off powering off are capped.
+	maxShutdownInhibitors = 10
+	maxInhibitDuration    = time.Hour
+)
+
+var (
+	// notifyShuttingDown and notifyShutdownCancelled tell D-Bus listeners
+	// that the device is about to power off, or no longer is. They are set
+	// when the D-Bus service is started.
+	notifyShuttingDown      = func() error { return nil }
+	notifyShutdownCancelled = func() error { return nil }
+
+	// These are variables so they can be replaced when testing.
+	stopUnits  = stopSystemdUnits
+	startUnits = startSystemdUnits
+	syncDisks  = syncFilesystems
+
+	inhibitors = newShutdownInhibitors()
+
+	// These are variables so they can be replaced when testing.
+	logindObject    = systemLogindObject
+	poweroffCommand = runPoweroffCommand
+)
+
+// shutdownPhase is one step of powering the device down. If a required phase
+// fails powering down stops, otherwise the error is logged and it carries on.
+type shutdownPhase struct {
+	name     string
+	required bool
+	run      func() error
+}
+
+// powerDown prepares the device for powering off then runs powerOff to ask
+// the ATtiny to power off and, if systemShutdown is set, halts the system.
+// Listeners are notified and given until the timeout to finish so files being
+// written aren't cut short. If an inhibitor is still held after the timeout,
+// or the filesystems can't be synced, powering off is cancelled. If the system
+// can't be halted cancelPowerOff is run so the ATtiny doesn't cut the power
+// while it is still running.
+func powerDown(conf Shutdown, powerOff, cancelPowerOff func() error, systemShutdown bool) error {
+	phases := []shutdownPhase{
+		{name: "notify listeners", run: notifyShuttingDown},
+		{name: "stop units", run: func() error { return stopUnits(conf.Units, conf.Timeout) }},
+		{name: "wait for inhibitors", required: true, run: func() error { return inhibitors.wait(conf.Timeout) }},
+		{name: "sync filesystems", required: true, run: syncDisks},
+		{name: "attiny power off", required: true, run: powerOff},
+	}
+	if err := runShutdownPhases(phases); err != nil {
+		cancelShutdown(conf)
+		return err
+	}
+	if !systemShutdown {
+		return nil
+	}
+	if err := runShutdownPhases([]shutdownPhase{
+		{name: "halt", required: true, run: haltSystem},
+	}); err != nil {
+		runShutdownPhases([]shutdownPhase{
+			{name: "cancel attiny power off", run: cancelPowerOff},
+		})
+		cancelShutdown(conf)
+		return err
+	}
+	return nil
+}
+
+// powerOffError is returned when a required shutdown phase failed, so the
+// device is still on and can try again later.
+type powerOffError struct {
+	phase string
+	err   error
+}
+
+func (e *powerOffError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.phase, e.err)
+}
+
+func (e *powerOffError) Unwrap() error {
+	return e.err
+}
+
+// cancelShutdown undoes the steps taken to prepare for powering off.
+func cancelShutdown(conf Shutdown) {
+	runShutdownPhases([]shutdownPhase{
+		{name: "start units", run: func() error { return startUnits(conf.Units, conf.Timeout) }},
+		{name: "notify listeners of cancel", run: notifyShutdownCancelled},
+	})
+}
+
+func runShutdownPhases(phases []shutdownPhase) error {
+	for _, phase := range phases {
+		log.Printf("shutdown: %s...", phase.name)
+		start := clock.Now()
+		err := phase.run()
+		took := clock.Now().Sub(start)
+		if err != nil {
+			log.Printf("shutdown: %s failed after %s: %v", phase.name, took, err)
+			if phase.required {
+				return &powerOffError{phase: phase.name, err: err}
+			}
+			continue
+		}
+		log.Printf("shutdown: %s took %s", phase.name, took)
+	}
+	return nil
+}
+
+// stopSystemdUnits stops the units, waiting up to timeout for them to stop.
+func stopSystemdUnits(units []string, timeout time.Duration) error {
+	if len(units) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "systemctl", append([]string{"stop"}, units...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to stop %s: %v\n%s", strings.Join(units, ", "), err, out)
+	}
+	return nil
+}
+
+// startSystemdUnits starts the units again if powering off was cancelled.
+func startSystemdUnits(units []string, timeout time.Duration) error {
+	if len(units) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "systemctl", append([]string{"start"}, units...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %v\n%s", strings.Join(units, ", "), err, out)
+	}
+	return nil
+}
+
+// syncFilesystems syncs then checks that the dirty data has been written.
+func syncFilesystems() error {
+	var dirty int
+	for i := 0; i < syncAttempts; i++ {
+		unix.Sync()
+		var err error
+		dirty, err = dirtyKB()
+		if err != nil {
+			return err
+		}
+		if dirty <= maxDirtyKB {
+			return nil
+		}
+	}
+	return fmt.Errorf("%d kB still to be written after syncing", dirty)
+}
+
+func dirtyKB() (int, error) {
+	f, err := os.Open(meminfoFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "Dirty:" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no Dirty entry in %s", meminfoFile)
+}
+
+// shutdown asks logind to power off the system, which respects any inhibitor
+// locks held by other services. If logind can't be reached the poweroff
+// command is used instead.
+func shutdown() error {
+	obj, err := logindObject()
+	if err == nil {
+		err = obj.Call("org.freedesktop.login1.Manager.PowerOff", 0, false).Err
+		if err == nil {
+			return nil
+		}
+		if !logindUnavailable(err) {
+			return fmt.Errorf("logind power off failed: %v", err)
+		}
+	}
+	log.Printf("failed to reach logind, using poweroff instead: %v", err)
+	return poweroffCommand()
+}
+
+// logindUnavailable returns true if the error from calling logind means it
+// isn't running, rather than it refusing to power off.
+func logindUnavailable(err error) bool {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) {
+		switch dbusErr.Name {
+		case "org.freedesktop.DBus.Error.ServiceUnknown",
+			"org.freedesktop.DBus.Error.NameHasNoOwner",
+			"org.freedesktop.DBus.Error.UnknownMethod":
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+func systemLogindObject() (dbus.BusObject, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Object("org.freedesktop.login1", "/org/freedesktop/login1"), nil
+}
+
+func runPoweroffCommand() error {
+	output, err := exec.Command("/sbin/poweroff").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("poweroff failed: %v\n%s", err, output)
+	}
+	return nil
+}
+
+// haltSystem shuts down the system and records if it worked in the history.
+func haltSystem() error {
+	err := shutdown()
+	updateCycle(func(c *cycleRecord) {
+		ok := err == nil
+		c.Shutdown = &ok
+		if err != nil {
+			c.ShutdownError = err.Error()
+		}
+	})
+	return err
+}
+
+// shutdownInhibitors are the names of listeners that have asked for the
+// device not to power off until they are done, and when they asked.
+type shutdownInhibitors struct {
+	mu      sync.Mutex
+	names   map[string]time.Time
+	changed chan struct{}
+}
+
+func newShutdownInhibitors() *shutdownInhibitors {
+	return &shutdownInhibitors{
+		names:   map[string]time.Time{},
+		changed: make(chan struct{}),
+	}
+}
+
+// inhibit adds an inhibitor, unless there are already too many. Inhibiting
+// again with the same name doesn't make it last any longer.
+func (i *shutdownInhibitors) inhibit(name string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.names[name]; ok {
+		return nil
+	}
+	if len(i.names) >= maxShutdownInhibitors {
+		return fmt.Errorf("already %d shutdown inhibitors", maxShutdownInhibitors)
+	}
+	i.names[name] = clock.Now()
+	i.notify()
+	return nil
+}
+
+func (i *shutdownInhibitors) release(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.names, name)
+	i.notify()
+}
+
+// notify wakes anything waiting for the inhibitors to change. Must be called
+// with the lock held.
+func (i *shutdownInhibitors) notify() {
+	close(i.changed)
+	i.changed = make(chan struct{})
+}
+
+// wait returns once there are no inhibitors, or an error listing the ones
+// left after the timeout. Inhibitors held for longer than maxInhibitDuration
+// are dropped.
+func (i *shutdownInhibitors) wait(timeout time.Duration) error {
+	var timedOut <-chan time.Time
+	for {
+		i.mu.Lock()
+		names := []string{}
+		for name, since := range i.names {
+			if clock.Now().Sub(since) >= maxInhibitDuration {
+				log.Printf("dropping shutdown inhibitor %s as it has been held since %s",
+					name, since.Format(time.UnixDate))
+				delete(i.names, name)
+				continue
+			}
+			names = append(names, name)
+		}
+		changed := i.changed
+		i.mu.Unlock()
+		if len(names) == 0 {
+			return nil
+		}
+		log.Printf("waiting for %s to finish", strings.Join(names, ", "))
+		if timedOut == nil {
+			timedOut = clock.After(timeout)
+		}
+
+		select {
+		case <-changed:
+		case <-timedOut:
+			sort.Strings(names)
+			return fmt.Errorf("timed out waiting for %s", strings.Join(names, ", "))
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownPhases(t *testing.T) {
+	ran := []string{}
+	phase := func(name string, required bool, err error) shutdownPhase {
+		return shutdownPhase{name: name, required: required, run: func() error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+
+	err := runShutdownPhases([]shutdownPhase{
+		phase("a", false, errors.New("failed")),
+		phase("b", true, nil),
+		phase("c", true, errors.New("failed")),
+		phase("d", true, nil),
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, ran)
+}
+
+func TestPowerDownOrder(t *testing.T) {
+	restoreGlobals(t)
+	ran := []string{}
+	notifyShuttingDown = func() error {
+		ran = append(ran, "notify")
+		return nil
+	}
+	stopUnits = func(units []string, timeout time.Duration) error {
+		ran = append(ran, "stop")
+		assert.Equal(t, []string{"thermal-recorder"}, units)
+		return nil
+	}
+	syncDisks = func() error {
+		ran = append(ran, "sync")
+		return nil
+	}
+
+	conf := Shutdown{Units: []string{"thermal-recorder"}, Timeout: time.Minute}
+	err := powerDown(conf, func() error {
+		ran = append(ran, "attiny")
+		return nil
+	}, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"notify", "stop", "sync", "attiny"}, ran)
+}
+
+func TestPowerDownAborted(t *testing.T) {
+	tests := []struct {
+		name    string
+		inhibit bool
+		syncErr error
+		want    string
+	}{
+		{name: "inhibitor held", inhibit: true, want: "wait for inhibitors failed: timed out waiting for recorder"},
+		{name: "sync failed", syncErr: errors.New("dirty"), want: "sync filesystems failed: dirty"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			restoreGlobals(t)
+			ran := []string{}
+			notifyShutdownCancelled = func() error {
+				ran = append(ran, "cancelled")
+				return nil
+			}
+			startUnits = func(units []string, timeout time.Duration) error {
+				ran = append(ran, "start")
+				return nil
+			}
+			syncDisks = func() error { return tc.syncErr }
+			inhibitors = newShutdownInhibitors()
+			if tc.inhibit {
+				require.NoError(t, inhibitors.inhibit("recorder"))
+			}
+
+			err := powerDown(Shutdown{Timeout: 10 * time.Millisecond}, func() error {
+				ran = append(ran, "attiny")
+				return nil
+			}, nil, true)
+			var powerOffErr *powerOffError
+			require.True(t, errors.As(err, &powerOffErr))
+			assert.EqualError(t, err, tc.want)
+			assert.Equal(t, []string{"start", "cancelled"}, ran)
+		})
+	}
+}
+
+func TestPowerDownCancelled(t *testing.T) {
+	restoreGlobals(t)
+	ran := []string{}
+	notifyShutdownCancelled = func() error {
+		ran = append(ran, "cancelled")
+		return nil
+	}
+	startUnits = func(units []string, timeout time.Duration) error {
+		ran = append(ran, "start")
+		return nil
+	}
+	syncDisks = func() error { return nil }
+
+	err := powerDown(Shutdown{}, func() error {
+		return errors.New("not counting down")
+	}, nil, true)
+	var powerOffErr *powerOffError
+	assert.True(t, errors.As(err, &powerOffErr))
+	assert.Equal(t, []string{"start", "cancelled"}, ran)
+}
+
+func TestPowerDownHaltFailed(t *testing.T) {
+	restoreGlobals(t)
+	ran := []string{}
+	notifyShutdownCancelled = func() error {
+		ran = append(ran, "cancelled")
+		return nil
+	}
+	startUnits = func(units []string, timeout time.Duration) error {
+		ran = append(ran, "start")
+		return nil
+	}
+	logind := &fakeLogind{err: dbus.Error{Name: "org.freedesktop.login1.OperationInProgress"}}
+	logindObject = func() (dbus.BusObject, error) { return logind, nil }
+	syncDisks = func() error { return nil }
+	statePath = ""
+
+	// Logind refusing to halt after the ATtiny is counting down cancels the
+	// power off so the device stays on and tries again.
+	err := powerDown(Shutdown{}, func() error {
+		ran = append(ran, "attiny")
+		return nil
+	}, func() error {
+		ran = append(ran, "cancel attiny")
+		return nil
+	}, true)
+	var powerOffErr *powerOffError
+	require.True(t, errors.As(err, &powerOffErr))
+	assert.Contains(t, err.Error(), "halt failed")
+	assert.Equal(t, []string{"attiny", "cancel attiny", "start", "cancelled"}, ran)
+}
+
+func TestShutdownInhibitors(t *testing.T) {
+	i := newShutdownInhibitors()
+	assert.NoError(t, i.wait(time.Second))
+
+	require.NoError(t, i.inhibit("recorder"))
+	require.NoError(t, i.inhibit("uploader"))
+	done := make(chan error)
+	go func() { done <- i.wait(time.Minute) }()
+	i.release("recorder")
+	i.release("uploader")
+	assert.NoError(t, <-done)
+
+	require.NoError(t, i.inhibit("recorder"))
+	assert.EqualError(t, i.wait(10*time.Millisecond), "timed out waiting for recorder")
+}
+
+func TestShutdownInhibitorLimits(t *testing.T) {
+	restoreGlobals(t)
+	c := &simClock{now: time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)}
+	clock = c
+	i := newShutdownInhibitors()
+
+	for n := 0; n < maxShutdownInhibitors; n++ {
+		require.NoError(t, i.inhibit(fmt.Sprintf("inhibitor-%d", n)))
+	}
+	assert.Error(t, i.inhibit("one-too-many"))
+	assert.NoError(t, i.inhibit("inhibitor-0"))
+
+	// Inhibiting again doesn't make it last longer.
+	c.Sleep(maxInhibitDuration / 2)
+	require.NoError(t, i.inhibit("inhibitor-0"))
+	c.Sleep(maxInhibitDuration / 2)
+	assert.NoError(t, i.wait(time.Minute))
+	assert.NoError(t, i.inhibit("one-too-many"))
+}
+
+// fakeLogind records the methods called on it and fails them with err.
+type fakeLogind struct {
+	calls []string
+	err   error
+}
+
+func (f *fakeLogind) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	f.calls = append(f.calls, method)
+	return &dbus.Call{Err: f.err}
+}
+
+func (f *fakeLogind) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	return f.Call(method, flags, args...)
+}
+
+func (f *fakeLogind) GetProperty(p string) (dbus.Variant, error) {
+	return dbus.Variant{}, nil
+}
+
+func (f *fakeLogind) Destination() string   { return "org.freedesktop.login1" }
+func (f *fakeLogind) Path() dbus.ObjectPath { return "/org/freedesktop/login1" }
+
+func TestShutdownThroughLogind(t *testing.T) {
+	restoreGlobals(t)
+	logind := &fakeLogind{}
+	logindObject = func() (dbus.BusObject, error) { return logind, nil }
+	commandRun := false
+	poweroffCommand = func() error {
+		commandRun = true
+		return nil
+	}
+
+	require.NoError(t, shutdown())
+	assert.Equal(t, []string{"org.freedesktop.login1.Manager.PowerOff"}, logind.calls)
+	assert.False(t, commandRun)
+
+	// Logind refusing to power off, such as when inhibited, isn't worked
+	// around.
+	logind.err = dbus.Error{Name: "org.freedesktop.login1.OperationInProgress"}
+	assert.Error(t, shutdown())
+	assert.False(t, commandRun)
+
+	// Falls back to the command if logind isn't running.
+	logind.err = dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}
+	require.NoError(t, shutdown())
+	assert.True(t, commandRun)
+
+	commandRun = false
+	logindObject = func() (dbus.BusObject, error) { return nil, errors.New("no system bus") }
+	require.NoError(t, shutdown())
+	assert.True(t, commandRun)
+}
@@ -0,0 +1,225 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+const simTimeFormat = "2006-01-02 15:04"
+
+// simClock is a virtual clock that moves forward whenever something sleeps.
+type simClock struct {
+	now time.Time
+}
+
+func (c *simClock) Sleep(d time.Duration) {
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
+// Now returns the virtual time in the local time zone, the same as time.Now.
+func (c *simClock) Now() time.Time {
+	return c.now.Local()
+}
+
+func (c *simClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// simATtiny records the power off requests made by the power machine.
+type simATtiny struct {
+	minutes int
+}
+
+func (a *simATtiny) PowerOff(minutes int) error {
+	if err := checkSleepMinutes(minutes); err != nil {
+		return err
+	}
+	a.minutes = minutes
+	log.Printf("ATtiny powering off for %d minutes", minutes)
+	return nil
+}
+
+func (a *simATtiny) CancelPowerOff() error {
+	a.minutes = 0
+	log.Println("ATtiny power off cancelled")
+	return nil
+}
+
+// simHeartbeats runs heartbeat loops on the virtual clock. On a device
+// heartbeats are sent from their own goroutine. Here they are run through
+// straight away and the clock is wound back after.
+type simHeartbeats struct {
+	clock *simClock
+	// runningUntil is when the last loop would have finished.
+	runningUntil time.Time
+	status       heartbeatStatus
+}
+
+func (h *simHeartbeats) Start(w *Schedule) {
+	if h.clock.now.Before(h.runningUntil) {
+		return
+	}
+	now := h.clock.now
+	heartBeatLoop(context.Background(), w, nil)
+	h.runningUntil = h.clock.now
+	h.clock.now = now
+}
+
+// Stop can't undo heartbeats already run through, instead they are dropped
+// from the log when powering off.
+func (h *simHeartbeats) Stop() {
+	h.runningUntil = time.Time{}
+}
+
+func (h *simHeartbeats) Reschedule(w *Schedule) {
+	h.Stop()
+	h.Start(w)
+}
+
+func (h *simHeartbeats) Status() heartbeatStatus {
+	return h.status
+}
+
+// simLog collects log lines stamped with the virtual time so lines from
+// heartbeats, which are run ahead of the power machine, can be printed in
+// order.
+type simLog struct {
+	clock   *simClock
+	out     io.Writer
+	entries []simLogEntry
+}
+
+type simLogEntry struct {
+	t    time.Time
+	line string
+}
+
+func (l *simLog) Write(p []byte) (int, error) {
+	l.entries = append(l.entries, simLogEntry{t: l.clock.Now(), line: string(p)})
+	return len(p), nil
+}
+
+// dropAfter removes lines from after t. Used when powering off to remove
+// heartbeats that would have been sent if the device stayed on.
+func (l *simLog) dropAfter(t time.Time) {
+	entries := l.entries[:0]
+	for _, e := range l.entries {
+		if !e.t.After(t) {
+			entries = append(entries, e)
+		}
+	}
+	l.entries = entries
+}
+
+func (l *simLog) flush() {
+	sort.SliceStable(l.entries, func(i, j int) bool {
+		return l.entries[i].t.Before(l.entries[j].t)
+	})
+	for _, e := range l.entries {
+		fmt.Fprintf(l.out, "%s %s", e.t.Format(simTimeFormat), e.line)
+	}
+	l.entries = nil
+}
+
+func runSimulation(args Args) error {
+	conf, err := ParseConfig(args.ConfigDir)
+	if err != nil {
+		return err
+	}
+	heartbeatConf = conf.Heartbeat
+	if args.Latitude != 0 || args.Longitude != 0 {
+		conf.OnWindow, err = NewSchedule(conf.PowerWindows, args.Latitude, args.Longitude)
+		if err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	if args.SimulateStart != "" {
+		start, err = time.ParseInLocation(yearMonthDayFormat, args.SimulateStart, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid simulation start date: %v", err)
+		}
+	}
+	return simulate(conf, start, time.Duration(args.SimulateDays)*24*time.Hour, os.Stdout)
+}
+
+// simulate runs the power machine from start for the given span, printing what
+// the device would do. Each power off is followed by a sleep on the virtual
+// clock and a fresh boot, the same as a device being woken by the ATtiny.
+func simulate(conf *AttinyConfig, start time.Time, span time.Duration, out io.Writer) error {
+	if conf.OnWindow.NoWindow {
+		fmt.Fprintln(out, "no window set so the device would stay on")
+		return nil
+	}
+
+	statePath = ""
+	historyPath = ""
+	c := &simClock{now: start}
+	simOut := &simLog{clock: c, out: out}
+	clock = c
+	log.SetOutput(simOut)
+	log.SetFlags(0)
+	defer log.SetOutput(os.Stderr)
+
+	addEvent = func(e eventclient.Event) error {
+		log.Printf("%s event: %v", e.Type, e.Details)
+		return nil
+	}
+	uploadEvents = func() error { return nil }
+	runningSaltJobs = func() ([]saltJob, error) { return nil, nil }
+	checkClockTrust = func(time.Time) (bool, string) { return true, "" }
+	syncDisks = func() error { return nil }
+	getModemConnectedSignal = func() (chan time.Time, error) {
+		return make(chan time.Time), nil
+	}
+	heartbeatSender = func(ctx context.Context, nextBeat time.Time, attempts int, sinks []heartbeatSink) error {
+		log.Printf("heartbeat valid until %s", nextBeat.Local().Format(simTimeFormat))
+		return nil
+	}
+	heartbeats = &simHeartbeats{clock: c}
+
+	a := &simATtiny{}
+	end := start.Add(span)
+	for c.Now().Before(end) {
+		log.Println("booted")
+		if err := newPowerMachine(conf, a, false, false).run(); err != nil {
+			return err
+		}
+		simOut.dropAfter(c.Now())
+		c.Sleep(time.Duration(a.minutes) * time.Minute)
+		log.Println("woken by ATtiny")
+		simOut.flush()
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulateOneDay(t *testing.T) {
+	restoreGlobals(t)
+	conf := &AttinyConfig{
+		OnWindow: newScheduleAt(t, at(12, 0), PowerWindow{PowerOn: "19:00", PowerOff: "07:00"}),
+		Power:    DefaultPower(),
+	}
+	var out strings.Builder
+	require.NoError(t, simulate(conf, at(12, 0), 24*time.Hour, &out))
+
+	got := []string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, "ATtiny") || strings.Contains(line, "heartbeat valid until") {
+			got = append(got, line)
+		}
+	}
+	assert.Equal(t, []string{
+		// Off after the grace period, waking at the wake lead before the window.
+		"2026-06-01 12:20 ATtiny powering off for 398 minutes",
+		"2026-06-01 18:58 woken by ATtiny",
+		"2026-06-01 19:28 heartbeat valid until 2026-06-01 23:28",
+		"2026-06-01 22:28 heartbeat valid until 2026-06-02 02:28",
+		"2026-06-02 01:28 heartbeat valid until 2026-06-02 05:28",
+		"2026-06-02 04:28 heartbeat valid until 2026-06-02 06:00",
+		"2026-06-02 05:55 heartbeat valid until 2026-06-02 07:00",
+		// The final heartbeat lasts until after the next window starts.
+		"2026-06-02 06:57 heartbeat valid until 2026-06-02 20:00",
+		"2026-06-02 07:00 ATtiny powering off for 718 minutes",
+		"2026-06-02 18:58 woken by ATtiny",
+	}, got)
+}
+
+func TestSimulateDays(t *testing.T) {
+	restoreGlobals(t)
+
+	conf := &AttinyConfig{
+		OnWindow: newScheduleAt(t, at(12, 0), PowerWindow{PowerOn: "19:00", PowerOff: "07:00"}),
+		Power:    DefaultPower(),
+	}
+	var out strings.Builder
+	start := time.Now()
+	require.NoError(t, simulate(conf, at(12, 0), 14*24*time.Hour, &out))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	// Powers off at the end of each night and during the first day.
+	assert.Equal(t, 15, strings.Count(out.String(), "power off requested"))
+	assert.Contains(t, out.String(), "2026-06-15 07:00")
+}
@@ -0,0 +1,109 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFile = "/var/lib/attiny-controller/state.json"
+
+var (
+	// statePath is where the state is saved. If empty the state is only kept
+	// in memory, as done by the simulator.
+	statePath = stateFile
+
+	state = &persistedState{}
+)
+
+// persistedState is what the controller keeps between power cycles.
+type persistedState struct {
+	mu sync.Mutex
+
+	// ChainedSleepUntil is set when a power off was longer than the ATtiny
+	// can sleep for in one go, so the device will wake before the window and
+	// needs to power off again.
+	ChainedSleepUntil time.Time `json:"chainedSleepUntil,omitempty"`
+
+	// LastKnownGoodTime is the latest time seen while the clock was trusted.
+	// The clock going back before this means it is wrong.
+	LastKnownGoodTime time.Time `json:"lastKnownGoodTime,omitempty"`
+
+	// SleepRate is how many real minutes pass for each minute the ATtiny is
+	// asked to sleep for. Zero means it hasn't been measured.
+	SleepRate float64 `json:"sleepRate,omitempty"`
+
+	// QueuedHeartbeats is the validUntil of a heartbeat that failed to send,
+	// by sink name. Each will be sent to its sink once it can be reached.
+	QueuedHeartbeats map[string]time.Time `json:"queuedHeartbeats,omitempty"`
+
+	// Cycle is the current power cycle, added to the history on next boot.
+	Cycle *cycleRecord `json:"cycle,omitempty"`
+}
+
+// loadState reads the state saved from the last power cycle. A missing state
+// file isn't an error.
+func loadState() error {
+	if statePath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return json.Unmarshal(b, state)
+}
+
+// update changes the state with f and saves it.
+func (s *persistedState) update(f func(s *persistedState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+	if statePath == "" {
+		return nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return err
+	}
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+// get calls f with the state locked.
+func (s *persistedState) get(f func(s *persistedState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
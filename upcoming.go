@@ -0,0 +1,170 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// maxCycles is the most power cycles that can be asked for at once.
+	maxCycles = 100
+
+	// maxUpcomingStayOn is how long the device can stay on through short
+	// gaps between windows before the schedule is given up on.
+	maxUpcomingStayOn = 7 * 24 * time.Hour
+)
+
+// cycleCount returns how many power cycles to give when n are asked for.
+func cycleCount(n int) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("number of power cycles must be at least 1, not %d", n)
+	}
+	if n > maxCycles {
+		return maxCycles, nil
+	}
+	return n, nil
+}
+
+// powerCycle is one upcoming on window and the power off that follows it.
+// A wake part way through a chained sleep is a cycle with the same power on
+// and power off time.
+type powerCycle struct {
+	PowerOn  time.Time `json:"powerOn"`
+	PowerOff time.Time `json:"powerOff"`
+	// SleepMinutes is what will be passed to the ATtiny when powering off.
+	SleepMinutes int `json:"sleepMinutes"`
+	// ChainedSleep is true when the next window is further away than the
+	// ATtiny can sleep for, so the device will wake to power off again.
+	ChainedSleep bool `json:"chainedSleep"`
+	// Heartbeats are the validUntil times of the heartbeats sent while on,
+	// ending with the final heartbeat sent before powering off.
+	Heartbeats []time.Time `json:"heartbeats"`
+}
+
+// upcomingSchedule works out the next n power cycles, up to maxCycles, for
+// the window starting from now. The window isn't modified. It follows the
+// power machine with a trusted clock and nothing else keeping the device on:
+// the device stays on through gaps between windows shorter than the
+// min-off-duration, and after a chained sleep wakes to power off again
+// straight away, which is given as a cycle of its own.
+func upcomingSchedule(w *Schedule, power Power, n int, now time.Time) ([]powerCycle, error) {
+	if w.NoWindow {
+		return nil, errors.New("no window set so the device stays on")
+	}
+	n, err := cycleCount(n)
+	if err != nil {
+		return nil, err
+	}
+	c := &simClock{now: now}
+	wc := *w
+	wc.Now = c.Now
+
+	cycles := []powerCycle{}
+	chained := false
+	for len(cycles) < n {
+		boot := c.Now()
+		var cycle powerCycle
+		if chained && !wc.Active() && longEnoughToPowerOff(int(wc.Until().Minutes()), power) {
+			cycle.PowerOn = boot
+			cycle.PowerOff = boot
+			cycle.Heartbeats = []time.Time{}
+		} else {
+			switch {
+			case wc.Active():
+				cycle.PowerOn = wc.PreviousStart()
+			case chained:
+				// Woke too close to the window to power off again.
+				cycle.PowerOn = boot
+			default:
+				cycle.PowerOn = boot.Add(wc.Until())
+			}
+			cycle.Heartbeats = plannedHeartbeats(&wc, c)
+			for {
+				c.now = wc.NextEnd()
+				cycle.PowerOff = c.now
+				cycle.Heartbeats = append(cycle.Heartbeats, finalHeartbeatValidUntil(&wc))
+				if longEnoughToPowerOff(int(wc.Until().Minutes()), power) {
+					break
+				}
+				// Stays on until the next window, which starts its own
+				// heartbeats.
+				c.now = c.now.Add(wc.Until())
+				if c.now.Sub(boot) > maxUpcomingStayOn {
+					return nil, fmt.Errorf("device doesn't power off for %s after %s as the gaps between windows are shorter than the min-off-duration",
+						maxUpcomingStayOn, boot)
+				}
+				cycle.Heartbeats = append(cycle.Heartbeats, plannedHeartbeats(&wc, c)...)
+			}
+		}
+		cycle.SleepMinutes, cycle.ChainedSleep = powerOffMinutes(int(wc.Until().Minutes()), power)
+		cycles = append(cycles, cycle)
+		chained = cycle.ChainedSleep
+
+		c.now = cycle.PowerOff.Add(time.Duration(cycle.SleepMinutes) * time.Minute)
+		if !c.now.After(boot) {
+			return nil, fmt.Errorf("window doesn't move forward from %s", boot)
+		}
+	}
+	return cycles, nil
+}
+
+// plannedHeartbeats gives the validUntil times of the heartbeats that a
+// heartbeat loop started at the current time would send. The clock is left
+// where it started. With no window heartbeats are sent for as long as the
+// device is on so none are planned.
+func plannedHeartbeats(w *Schedule, c *simClock) []time.Time {
+	if w.NoWindow {
+		return nil
+	}
+	start := c.now
+	defer func() { c.now = start }()
+
+	hb := NewHeartbeat(w)
+	hb.clock = c
+	beats := []time.Time{}
+	c.Sleep(hb.initialDelay())
+	for {
+		done := hb.updateNextBeat()
+		beats = append(beats, hb.validUntil)
+		if done {
+			return beats
+		}
+		c.Sleep(hb.untilNextBeat())
+	}
+}
+
+func printSchedule(out io.Writer, cycles []powerCycle) {
+	for _, cycle := range cycles {
+		chained := ""
+		if cycle.ChainedSleep {
+			chained = " (will wake to power off again)"
+		}
+		fmt.Fprintf(out, "on %s until %s, then off for %d minutes%s\n",
+			cycle.PowerOn.Local().Format(simTimeFormat),
+			cycle.PowerOff.Local().Format(simTimeFormat),
+			cycle.SleepMinutes, chained)
+		for _, beat := range cycle.Heartbeats {
+			fmt.Fprintf(out, "    heartbeat valid until %s\n", beat.Local().Format(simTimeFormat))
+		}
+	}
+}
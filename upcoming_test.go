@@ -0,0 +1,208 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nextDay is at for the day after.
+func nextDay(hour, minute int) time.Time {
+	return at(hour, minute).AddDate(0, 0, 1)
+}
+
+func TestUpcomingSchedule(t *testing.T) {
+	overnight := PowerWindow{PowerOn: "19:00", PowerOff: "07:00"}
+	alwaysOn := PowerWindow{PowerOn: "12:00", PowerOff: "12:00"}
+	tests := []struct {
+		name    string
+		now     time.Time
+		windows []PowerWindow
+		n       int
+		want    []powerCycle
+		wantLen int
+		wantErr string
+	}{
+		{
+			name:    "across midnight",
+			now:     at(12, 0),
+			windows: []PowerWindow{overnight},
+			n:       1,
+			want: []powerCycle{{
+				PowerOn:      at(19, 0),
+				PowerOff:     nextDay(7, 0),
+				SleepMinutes: 718,
+				Heartbeats: []time.Time{
+					at(23, 0), nextDay(2, 0), nextDay(5, 0), nextDay(6, 0), nextDay(7, 0), nextDay(20, 0),
+				},
+			}},
+		},
+		{
+			name:    "booted in window",
+			now:     at(23, 30),
+			windows: []PowerWindow{overnight},
+			n:       1,
+			want: []powerCycle{{
+				PowerOn:      at(19, 0),
+				PowerOff:     nextDay(7, 0),
+				SleepMinutes: 718,
+				Heartbeats:   []time.Time{nextDay(4, 0), nextDay(6, 0), nextDay(7, 0), nextDay(20, 0)},
+			}},
+		},
+		{
+			name:    "stays on through short gap",
+			now:     at(12, 0),
+			windows: []PowerWindow{overnight, {PowerOn: "07:10", PowerOff: "08:00"}},
+			n:       1,
+			want: []powerCycle{{
+				PowerOn:      at(19, 0),
+				PowerOff:     nextDay(8, 0),
+				SleepMinutes: 658,
+				Heartbeats: []time.Time{
+					at(23, 0), nextDay(2, 0), nextDay(5, 0), nextDay(6, 0), nextDay(7, 0), nextDay(8, 10),
+					nextDay(8, 0), nextDay(20, 0),
+				},
+			}},
+		},
+		{
+			name:    "never long enough to power off",
+			now:     at(12, 0),
+			windows: []PowerWindow{overnight, {PowerOn: "07:10", PowerOff: "18:55"}},
+			n:       1,
+			wantErr: "device doesn't power off for 168h0m0s after " + at(12, 0).String() +
+				" as the gaps between windows are shorter than the min-off-duration",
+		},
+		{
+			name:    "chained sleep",
+			now:     at(12, 0),
+			windows: []PowerWindow{{PowerOn: "19:00", PowerOff: "07:00", From: "06-01", To: "06-01"}},
+			n:       3,
+			want: []powerCycle{
+				{
+					PowerOn:      at(19, 0),
+					PowerOff:     nextDay(7, 0),
+					SleepMinutes: maxSleepMinutes,
+					ChainedSleep: true,
+					Heartbeats: []time.Time{
+						at(23, 0), nextDay(2, 0), nextDay(5, 0), nextDay(6, 0), nextDay(7, 0), at(20, 0).AddDate(1, 0, 0),
+					},
+				},
+				{
+					PowerOn:      nextDay(7, 0).Add(maxSleepMinutes * time.Minute),
+					PowerOff:     nextDay(7, 0).Add(maxSleepMinutes * time.Minute),
+					SleepMinutes: maxSleepMinutes,
+					ChainedSleep: true,
+					Heartbeats:   []time.Time{},
+				},
+				{
+					PowerOn:      nextDay(7, 0).Add(2 * maxSleepMinutes * time.Minute),
+					PowerOff:     nextDay(7, 0).Add(2 * maxSleepMinutes * time.Minute),
+					SleepMinutes: maxSleepMinutes,
+					ChainedSleep: true,
+					Heartbeats:   []time.Time{},
+				},
+			},
+		},
+		{
+			name:    "capped",
+			now:     at(12, 0),
+			windows: []PowerWindow{overnight},
+			n:       maxCycles + 1,
+			wantLen: maxCycles,
+		},
+		{
+			name:    "always on",
+			now:     at(12, 0),
+			windows: []PowerWindow{alwaysOn},
+			n:       1,
+			wantErr: "no window set so the device stays on",
+		},
+		{
+			name:    "none asked for",
+			now:     at(12, 0),
+			windows: []PowerWindow{overnight},
+			n:       0,
+			wantErr: "number of power cycles must be at least 1, not 0",
+		},
+		{
+			name:    "negative",
+			now:     at(12, 0),
+			windows: []PowerWindow{overnight},
+			n:       -1,
+			wantErr: "number of power cycles must be at least 1, not -1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newScheduleAt(t, tc.now, tc.windows...)
+			cycles, err := upcomingSchedule(w, DefaultPower(), tc.n, tc.now)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if tc.want != nil {
+				assert.Equal(t, tc.want, cycles)
+			}
+			if tc.wantLen != 0 {
+				assert.Len(t, cycles, tc.wantLen)
+			}
+		})
+	}
+}
+
+func TestPlannedHeartbeats(t *testing.T) {
+	overnight := PowerWindow{PowerOn: "19:00", PowerOff: "07:00"}
+	alwaysOn := PowerWindow{PowerOn: "12:00", PowerOff: "12:00"}
+	tests := []struct {
+		name    string
+		now     time.Time
+		windows []PowerWindow
+		want    []time.Time
+	}{
+		{
+			name:    "before window",
+			now:     at(12, 0),
+			windows: []PowerWindow{overnight},
+			want:    []time.Time{at(23, 0), nextDay(2, 0), nextDay(5, 0), nextDay(6, 0), nextDay(7, 0)},
+		},
+		{
+			name:    "window start",
+			now:     at(19, 0),
+			windows: []PowerWindow{overnight},
+			want:    []time.Time{at(23, 30), nextDay(2, 30), nextDay(5, 30), nextDay(6, 0), nextDay(7, 0)},
+		},
+		{
+			name:    "before midnight",
+			now:     at(23, 30),
+			windows: []PowerWindow{overnight},
+			want:    []time.Time{nextDay(4, 0), nextDay(6, 0), nextDay(7, 0)},
+		},
+		{
+			name:    "after midnight",
+			now:     at(2, 0),
+			windows: []PowerWindow{overnight},
+			want:    []time.Time{at(6, 0), at(7, 0)},
+		},
+		{
+			name:    "always on",
+			now:     at(12, 0),
+			windows: []PowerWindow{alwaysOn},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &simClock{now: tc.now}
+			w := newScheduleAt(t, tc.now, tc.windows...)
+			w.Now = c.Now
+			assert.Equal(t, tc.want, plannedHeartbeats(w, c))
+			assert.Equal(t, tc.now, c.now)
+		})
+	}
+}
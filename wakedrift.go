@@ -0,0 +1,165 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+const (
+	uptimeFile = "/proc/uptime"
+
+	// How far from the expected time the device can wake and still be
+	// counted as waking on time. Waking further out makes a wake-drift event.
+	wakeDriftThreshold = 5 * time.Minute
+
+	// The sleep rate is only updated from sleeps at least this long, and
+	// from measurements within the bounds, to keep out bad readings.
+	minRateSleepMinutes = 60
+	minSleepRate        = 0.8
+	maxSleepRate        = 1.2
+	// How much each new measurement moves the sleep rate.
+	sleepRateWeight = 0.3
+)
+
+// systemUptime is a variable so it can be replaced when testing.
+var systemUptime = readUptime
+
+// checkWakeDrift compares when the device was expected to wake with when it
+// booted and makes a wake-drift event if they are too far apart. The sleep
+// is also used to update how fast the ATtiny counts minutes. The boot time
+// is worked out from the uptime so this can be done once the clock is trusted,
+// even if it wasn't right at boot. Nothing is checked if the clock was set
+// from the ATtiny, as the wake would then be measured by the ATtiny itself.
+func checkWakeDrift(now time.Time) {
+	if clockFromATtiny {
+		log.Println("not checking wake drift as the clock was set from the attiny")
+		return
+	}
+	var cycle cycleRecord
+	var found bool
+	state.get(func(s *persistedState) {
+		if s.Cycle != nil {
+			cycle = *s.Cycle
+			found = true
+		}
+	})
+	if !found || cycle.ExpectedWake.IsZero() || !cycle.ActualWake.IsZero() {
+		return
+	}
+	if cycle.WakeReason != wakeScheduled.String() && cycle.WakeReason != wakeUnknown.String() {
+		// Woken for some other reason before the sleep finished.
+		return
+	}
+	uptime, err := systemUptime()
+	if err != nil {
+		log.Printf("failed to read uptime: %v", err)
+		return
+	}
+	actualWake := now.Add(-uptime).Truncate(time.Second)
+	drift := actualWake.Sub(cycle.ExpectedWake)
+	onTime := drift <= wakeDriftThreshold && drift >= -wakeDriftThreshold
+	err = state.update(func(s *persistedState) {
+		s.Cycle.ActualWake = actualWake
+		s.Cycle.WakeDriftSeconds = int64(drift / time.Second)
+		s.Cycle.WokeOnTime = &onTime
+		s.SleepRate = updatedSleepRate(s.SleepRate, cycle.SleepStart, actualWake, cycle.SleepMinutes)
+	})
+	if err != nil {
+		log.Printf("failed to save wake drift: %v", err)
+	}
+	log.Printf("woke %s from the expected time of %s", drift, cycle.ExpectedWake.Format(time.UnixDate))
+	if onTime {
+		return
+	}
+	err = addEvent(eventclient.Event{
+		Timestamp: now,
+		Type:      "wake-drift",
+		Details: map[string]interface{}{
+			"expectedWake":        cycle.ExpectedWake,
+			"actualWake":          actualWake,
+			"driftSeconds":        int64(drift / time.Second),
+			"sleepStart":          cycle.SleepStart,
+			"plannedSleepMinutes": int(cycle.ExpectedWake.Sub(cycle.SleepStart).Minutes()),
+		},
+	})
+	if err != nil {
+		log.Printf("failed to make wake-drift event: %v", err)
+	}
+}
+
+// updatedSleepRate folds a measured sleep into the sleep rate, returning the
+// rate unchanged if the measurement can't be used.
+func updatedSleepRate(rate float64, sleepStart, actualWake time.Time, sleepMinutes int) float64 {
+	if sleepStart.IsZero() || sleepMinutes < minRateSleepMinutes {
+		return rate
+	}
+	measured := actualWake.Sub(sleepStart).Minutes() / float64(sleepMinutes)
+	if measured < minSleepRate || measured > maxSleepRate {
+		log.Printf("ignoring sleep rate of %.4f as it is out of bounds", measured)
+		return rate
+	}
+	if rate == 0 {
+		rate = 1
+	}
+	rate += (measured - rate) * sleepRateWeight
+	log.Printf("measured sleep rate of %.4f, sleep rate is now %.4f", measured, rate)
+	return rate
+}
+
+// correctSleepMinutes adjusts the minutes to ask the ATtiny to sleep for so
+// the device wakes after the wanted number of real minutes.
+func correctSleepMinutes(minutes int) int {
+	var rate float64
+	state.get(func(s *persistedState) { rate = s.SleepRate })
+	if rate == 0 {
+		return minutes
+	}
+	corrected := int(math.Round(float64(minutes) / rate))
+	if corrected < 1 {
+		corrected = 1
+	} else if corrected > maxSleepMinutes {
+		corrected = maxSleepMinutes
+	}
+	return corrected
+}
+
+func readUptime() (time.Duration, error) {
+	b, err := os.ReadFile(uptimeFile)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("no uptime in %s", uptimeFile)
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWakeDrift(t *testing.T) {
+	restoreGlobals(t)
+	statePath = ""
+	events := []eventclient.Event{}
+	addEvent = func(e eventclient.Event) error {
+		events = append(events, e)
+		return nil
+	}
+
+	expected := time.Date(2026, 6, 1, 19, 0, 0, 0, time.UTC)
+	now := expected.Add(time.Hour)
+	newCycle := func(reason wakeReason) {
+		state = &persistedState{Cycle: &cycleRecord{
+			WakeReason:   reason.String(),
+			SleepStart:   expected.Add(-10 * time.Hour),
+			SleepMinutes: 600,
+			ExpectedWake: expected,
+		}}
+	}
+
+	// Woke two minutes late.
+	newCycle(wakeScheduled)
+	systemUptime = func() (time.Duration, error) { return 58 * time.Minute, nil }
+	checkWakeDrift(now)
+	require.NotNil(t, state.Cycle.WokeOnTime)
+	assert.True(t, *state.Cycle.WokeOnTime)
+	assert.EqualValues(t, 120, state.Cycle.WakeDriftSeconds)
+	assert.Empty(t, events)
+	assert.InDelta(t, 1+(2.0/600)*sleepRateWeight, state.SleepRate, 1e-9)
+
+	// Only checked once.
+	systemUptime = func() (time.Duration, error) { return 0, nil }
+	checkWakeDrift(now)
+	assert.EqualValues(t, 120, state.Cycle.WakeDriftSeconds)
+
+	// Woke 20 minutes early.
+	newCycle(wakeScheduled)
+	systemUptime = func() (time.Duration, error) { return 80 * time.Minute, nil }
+	checkWakeDrift(now)
+	assert.False(t, *state.Cycle.WokeOnTime)
+	assert.EqualValues(t, -1200, state.Cycle.WakeDriftSeconds)
+	require.Len(t, events, 1)
+	assert.Equal(t, "wake-drift", events[0].Type)
+	assert.Equal(t, 600, events[0].Details["plannedSleepMinutes"])
+
+	// Not a scheduled wake.
+	newCycle(wakeWatchdog)
+	checkWakeDrift(now)
+	assert.Nil(t, state.Cycle.WokeOnTime)
+	assert.Len(t, events, 1)
+}
+
+func TestWakeDriftClockFromATtiny(t *testing.T) {
+	restoreGlobals(t)
+	statePath = ""
+	events := []eventclient.Event{}
+	addEvent = func(e eventclient.Event) error {
+		events = append(events, e)
+		return nil
+	}
+	uptimeReads := 0
+	systemUptime = func() (time.Duration, error) {
+		uptimeReads++
+		return 80 * time.Minute, nil
+	}
+	clockFromATtiny = true
+
+	expected := time.Date(2026, 6, 1, 19, 0, 0, 0, time.UTC)
+	state = &persistedState{
+		SleepRate: 1.01,
+		Cycle: &cycleRecord{
+			WakeReason:   wakeScheduled.String(),
+			SleepStart:   expected.Add(-10 * time.Hour),
+			SleepMinutes: 600,
+			ExpectedWake: expected,
+		},
+	}
+	checkWakeDrift(expected.Add(time.Hour))
+	assert.Zero(t, uptimeReads)
+	assert.Nil(t, state.Cycle.WokeOnTime)
+	assert.True(t, state.Cycle.ActualWake.IsZero())
+	assert.Equal(t, 1.01, state.SleepRate)
+	assert.Empty(t, events)
+}
+
+func TestSleepRate(t *testing.T) {
+	restoreGlobals(t)
+	start := time.Date(2026, 6, 1, 7, 0, 0, 0, time.UTC)
+
+	// Woke 10 minutes late after 600 minutes.
+	rate := updatedSleepRate(0, start, start.Add(610*time.Minute), 600)
+	assert.InDelta(t, 1+(10.0/600)*sleepRateWeight, rate, 1e-9)
+
+	// Too short or out of bounds measurements are ignored.
+	assert.Equal(t, rate, updatedSleepRate(rate, start, start.Add(40*time.Minute), 30))
+	assert.Equal(t, rate, updatedSleepRate(rate, start, start.Add(900*time.Minute), 600))
+	assert.Equal(t, rate, updatedSleepRate(rate, time.Time{}, start, 600))
+
+	state = &persistedState{}
+	assert.Equal(t, 600, correctSleepMinutes(600))
+	state = &persistedState{SleepRate: 1.02}
+	assert.Equal(t, 588, correctSleepMinutes(600))
+	state = &persistedState{SleepRate: 0.9}
+	assert.Equal(t, maxSleepMinutes, correctSleepMinutes(maxSleepMinutes))
+}